@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// isAdmin reports whether the request carries the admin password in
+// its basic auth credentials.  The user name is ignored.
+func (s *Server) isAdmin(r *http.Request) bool {
+	if s.adminPassword == "" {
+		return false
+	}
+	_, pass, ok := r.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(s.adminPassword)) == 1
+}
+
+// handleAdminError writes e as a plain-text response, asking for
+// credentials if needed.
+func (s *Server) handleAdminError(w http.ResponseWriter, e *appError) {
+	if e.Error != nil {
+		s.log.Printf("%s: %v", e.Message, e.Error)
+	}
+	if e.Code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Bike the Big Apple admin"`)
+	}
+	http.Error(w, e.Message, e.Code)
+}
+
+type TeamVars struct {
+	Guide string
+	Sweep string
+}
+
+// AdminTeamsVars represents the form inputs.  From and To select two
+// versions to compare; Saved is the version just created, if any.
+type AdminTeamsVars struct {
+	TourID    int32 `schema:"TourId"`
+	Teams     []TeamVars
+	From      int
+	To        int
+	Saved     int
+	CSRFToken string
+}
+
+// TeamRow is one row of the teams form.  Index is the form index and
+// Display the team number shown to the user.
+type TeamRow struct {
+	Index   int
+	Display int
+	Guide   string
+	Sweep   string
+}
+
+// TeamVersion is an entry in the assignment history.  Previous is
+// zero for the first version.
+type TeamVersion struct {
+	Version  int
+	Previous int
+}
+
+// AdminTeamsData is the data passed to the admin teams template.
+type AdminTeamsData struct {
+	Page
+	TourDetail *TourDetail
+	CSRFToken  string // also set in a cookie
+	Version    int    // 0 if never assigned
+	Rows       []*TeamRow
+	Versions   []*TeamVersion
+	Saved      int
+
+	DiffFrom int
+	DiffTo   int
+	Diff     []*TeamChange
+}
+
+const extraTeamRows = 2
+
+func (s *Server) adminTeams(r *http.Request) (*AdminTeamsData, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if !s.isAdmin(r) {
+		return nil, warnings, &appError{http.StatusUnauthorized, "Unauthorized", nil}
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars AdminTeamsVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	token, e := adminCSRF(r, vars.CSRFToken)
+	if e != nil {
+		return nil, warnings, e
+	}
+	tourDetail, ok, err := s.store.GetTourDetailByID(r.Context(), vars.TourID, maxRiders)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourDetailByID: %v", err)}
+	}
+	if !ok {
+		return nil, warnings, &appError{http.StatusBadRequest, fmt.Sprintf("Invalid tour ID %d", vars.TourID), nil}
+	}
+	current, err := s.store.GetTeams(r.Context(), vars.TourID)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTeams: %v", err)}
+	}
+
+	if r.Method == "POST" {
+		var teams []*Team
+		for _, t := range vars.Teams {
+			team := &Team{strings.TrimSpace(t.Guide), strings.TrimSpace(t.Sweep)}
+			if team.Guide != "" || team.Sweep != "" {
+				teams = append(teams, team)
+			}
+		}
+		if len(diffTeams(current, teams)) > 0 {
+			version, previous, err := s.store.CreateTeamsVersion(r.Context(), vars.TourID, teams)
+			if err != nil {
+				return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("CreateTeamsVersion: %v", err)}
+			}
+			// The new version is saved, so tell the guides even if the
+			// admin has gone.  Another admin may have saved since we
+			// read current, so compare with what was replaced.
+			s.notifyGuides(context.WithoutCancel(r.Context()), tourDetail, previous, teams, warnings)
+			current = teams
+			vars.Saved = version
+		}
+	}
+
+	versions, err := s.store.GetTeamVersions(r.Context(), vars.TourID)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTeamVersions: %v", err)}
+	}
+	data := &AdminTeamsData{
+		Page:       staffPage(r),
+		TourDetail: tourDetail,
+		CSRFToken:  token,
+		Saved:      vars.Saved,
+	}
+	if len(versions) > 0 {
+		data.Version = versions[0]
+	}
+	// As with NumRidersOption, we number the rows here because
+	// there's no arithmetic in templates.
+	for i := 0; i < len(current)+extraTeamRows; i++ {
+		row := &TeamRow{Index: i, Display: i + 1}
+		if i < len(current) {
+			row.Guide, row.Sweep = current[i].Guide, current[i].Sweep
+		}
+		data.Rows = append(data.Rows, row)
+	}
+	for i, v := range versions { // newest first
+		tv := &TeamVersion{Version: v}
+		if i+1 < len(versions) {
+			tv.Previous = versions[i+1]
+		}
+		data.Versions = append(data.Versions, tv)
+	}
+	if vars.From > 0 && vars.To > 0 {
+		from, err := s.store.GetTeamsVersion(r.Context(), vars.TourID, vars.From)
+		if err != nil {
+			return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTeamsVersion: %v", err)}
+		}
+		to, err := s.store.GetTeamsVersion(r.Context(), vars.TourID, vars.To)
+		if err != nil {
+			return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTeamsVersion: %v", err)}
+		}
+		data.DiffFrom, data.DiffTo = vars.From, vars.To
+		data.Diff = diffTeams(from, to)
+	}
+	return data, warnings, nil
+}
+
+func (s *Server) HandleAdminTeams(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	data, warnings, e := s.adminTeams(r)
+	if e != nil {
+		s.handleAdminError(w, e)
+		return e.Code, warnings, e.Message
+	}
+	summary = fmt.Sprintf("tour:%d version:%d", data.TourDetail.ID, data.Version)
+	if data.Saved > 0 {
+		summary += " saved"
+	}
+	tmpl, err := s.templates.Get("admin_teams.html")
+	if err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error parsing admin teams template"
+	}
+	s.setCSRFCookie(w, data.CSRFToken)
+	if err := tmpl.Execute(w, data); err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error executing admin teams template"
+	}
+	return http.StatusOK, warnings, summary
+}
+
+// AdminRidersVars represents the form inputs.
+type AdminRidersVars struct {
+	OrderID int32 `schema:"OrderNum"`
+}
+
+// AdminRidersData is the JSON response listing an order's riders.
+// Heights is the legacy display string for the same riders.
+type AdminRidersData struct {
+	OrderID int32   `json:"order_num"`
+	Heights string  `json:"heights"`
+	Riders  []Rider `json:"riders"`
+}
+
+func (s *Server) adminRiders(r *http.Request) (*AdminRidersData, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if !s.isAdmin(r) {
+		return nil, warnings, &appError{http.StatusUnauthorized, "Unauthorized", nil}
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars AdminRidersVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	if vars.OrderID <= 0 {
+		return nil, warnings, &appError{http.StatusBadRequest, "Missing OrderNum", nil}
+	}
+	riders, err := s.store.GetOrderRiders(r.Context(), vars.OrderID)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetOrderRiders: %v", err)}
+	}
+	return &AdminRidersData{vars.OrderID, heightsString(riders), riders}, warnings, nil
+}
+
+func (s *Server) HandleAdminRiders(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	data, warnings, e := s.adminRiders(r)
+	if e != nil {
+		s.handleAdminError(w, e)
+		return e.Code, warnings, e.Message
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		s.log.Printf("%v", err)
+	}
+	return http.StatusOK, warnings, fmt.Sprintf("order:%d riders:%d", data.OrderID, len(data.Riders))
+}
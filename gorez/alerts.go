@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// eventServerError is matched by alert rules like a warning whenever
+// a handler responds with a 5xx status, e.g. during a MySQL outage.
+const eventServerError = "http/5xx"
+
+// AlertRule says which warnings need a human.  Pattern is a warning
+// like "db_failure/payment_recorded", a whole category like
+// "db_failure/*", or eventServerError.  The rule fires once Count
+// matching requests are seen within Window.
+type AlertRule struct {
+	Pattern string
+	Count   int
+	Window  time.Duration
+}
+
+func (r *AlertRule) matches(event string) bool {
+	if strings.HasSuffix(r.Pattern, "/*") {
+		return strings.HasPrefix(event, strings.TrimSuffix(r.Pattern, "*"))
+	}
+	return event == r.Pattern
+}
+
+// parseAlertRules parses a list like
+// "db_failure/payment_recorded,email_failure/*,http/5xx=5/10m", where
+// "=5/10m" means five matching requests within ten minutes.  Rules
+// without it fire on the first match.
+func parseAlertRules(s string) ([]*AlertRule, error) {
+	var rules []*AlertRule
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		rule := &AlertRule{Pattern: f, Count: 1}
+		if i := strings.Index(f, "="); i >= 0 {
+			rule.Pattern = strings.TrimSpace(f[:i])
+			count, window, ok := strings.Cut(strings.TrimSpace(f[i+1:]), "/")
+			var err error
+			if rule.Count, err = strconv.Atoi(count); !ok || err != nil || rule.Count <= 0 {
+				return nil, fmt.Errorf("invalid alert rule %q", f)
+			}
+			if rule.Window, err = time.ParseDuration(window); err != nil || rule.Window <= 0 {
+				return nil, fmt.Errorf("invalid alert rule %q", f)
+			}
+		}
+		if !strings.Contains(rule.Pattern, "/") {
+			return nil, fmt.Errorf("invalid alert rule %q: want category/name", f)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Alert is one notification to the operators.  It is also the JSON
+// body posted to webhooks.
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Event    string    `json:"event"` // the warning that set it off
+	Route    string    `json:"route"`
+	Summary  string    `json:"summary"`
+	Count    int       `json:"count"` // matching requests since the rule last fired
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+}
+
+func (a *Alert) subject() string {
+	return fmt.Sprintf("[gorez alert] %s on %s", a.Event, a.Route)
+}
+
+func (a *Alert) body() string {
+	return fmt.Sprintf("Rule:     %s\nEvent:    %s\nRoute:    %s\nSummary:  %s\nCount:    %d since the last alert for this rule\nTime:     %s\nInstance: %s\n",
+		a.Rule, a.Event, a.Route, a.Summary, a.Count, a.Time.Format(time.RFC3339), a.Instance)
+}
+
+// AlertSink delivers alerts.
+type AlertSink interface {
+	SendAlert(a *Alert) error
+}
+
+// Alerter checks the warnings from each request against the rules and
+// notifies the sinks.  After a rule fires it stays quiet for cooldown,
+// counting what it holds back, so an outage that breaks every request
+// produces one alert.  No more than maxPerHour alerts go out in total.
+type Alerter struct {
+	rules      []*AlertRule
+	sinks      []AlertSink
+	cooldown   time.Duration
+	maxPerHour int
+	instance   string
+	log        *log.Logger
+
+	wg    sync.WaitGroup // alerts being sent
+	mu    sync.Mutex
+	state map[*AlertRule]*alertState
+	sent  []time.Time // alerts sent in the last hour
+}
+
+type alertState struct {
+	recent    []time.Time // matches within the rule's window
+	pending   int         // matches since the rule last fired
+	lastFired time.Time
+}
+
+func NewAlerter(rules []*AlertRule, sinks []AlertSink, cooldown time.Duration, maxPerHour int, log *log.Logger) *Alerter {
+	return &Alerter{
+		rules:      rules,
+		sinks:      sinks,
+		cooldown:   cooldown,
+		maxPerHour: maxPerHour,
+		instance:   instanceName(),
+		log:        log,
+		state:      make(map[*AlertRule]*alertState),
+	}
+}
+
+// Observe checks a handled request.  Alerts are sent in the
+// background.  A nil Alerter does nothing.
+func (a *Alerter) Observe(route string, code int, warnings map[warning]bool, summary string) {
+	if a == nil {
+		return
+	}
+	events := warningsList(warnings)
+	if code >= 500 {
+		events = append(events, eventServerError)
+	}
+	for _, alert := range a.check(time.Now(), route, events, summary) {
+		a.wg.Add(1)
+		go func(alert *Alert) {
+			defer a.wg.Done()
+			a.send(alert)
+		}(alert)
+	}
+}
+
+// Wait waits for alerts being sent.  A nil Alerter does nothing.
+func (a *Alerter) Wait() {
+	if a != nil {
+		a.wg.Wait()
+	}
+}
+
+// check returns the alerts that the events seen at now set off.
+func (a *Alerter) check(now time.Time, route string, events []string, summary string) []*Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var alerts []*Alert
+	for _, rule := range a.rules {
+		event := ""
+		for _, e := range events {
+			if rule.matches(e) {
+				event = e
+				break
+			}
+		}
+		if event == "" {
+			continue
+		}
+		st := a.state[rule]
+		if st == nil {
+			st = &alertState{}
+			a.state[rule] = st
+		}
+		st.pending++
+		st.recent = append(dropBefore(st.recent, now.Add(-rule.Window)), now)
+		if len(st.recent) < rule.Count {
+			continue
+		}
+		if !st.lastFired.IsZero() && now.Sub(st.lastFired) < a.cooldown {
+			continue // already alerted
+		}
+		a.sent = dropBefore(a.sent, now.Add(-time.Hour))
+		if len(a.sent) >= a.maxPerHour {
+			continue // held back until the hour has room
+		}
+		alerts = append(alerts, &Alert{
+			Rule:     rule.Pattern,
+			Event:    event,
+			Route:    route,
+			Summary:  summary,
+			Count:    st.pending,
+			Time:     now,
+			Instance: a.instance,
+		})
+		st.pending, st.recent, st.lastFired = 0, nil, now
+		a.sent = append(a.sent, now)
+	}
+	return alerts
+}
+
+// dropBefore removes the times before t from a sorted list.
+func dropBefore(times []time.Time, t time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(t) {
+		i++
+	}
+	return times[i:]
+}
+
+func (a *Alerter) send(alert *Alert) {
+	for _, sink := range a.sinks {
+		if err := sink.SendAlert(alert); err != nil {
+			a.log.Printf("Error sending alert %q: %v", alert.Rule, err)
+		}
+	}
+}
+
+// EmailAlertSink emails alerts to the operators.
+type EmailAlertSink struct {
+	server *Server
+	to     []string
+}
+
+func NewEmailAlertSink(server *Server, to []string) *EmailAlertSink {
+	return &EmailAlertSink{server, to}
+}
+
+func (e *EmailAlertSink) SendAlert(a *Alert) error {
+	from := mail.NewEmail("gorez alerts", "reservations@bikethebigapple.com")
+	for _, addr := range e.to {
+		if err := e.server.sendEmail(context.Background(), from, mail.NewEmail("", addr), nil /*bcc*/, a.subject(), a.body()); err != nil {
+			return fmt.Errorf("email %s: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// WebhookAlertSink posts alerts as JSON, for chat or paging services.
+type WebhookAlertSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookAlertSink(url string) *WebhookAlertSink {
+	return &WebhookAlertSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (h *WebhookAlertSink) SendAlert(a *Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// Frame sizes from smallest to largest.  Bikes.FrameSize holds one of
+// these.
+var frameSizes = []string{"XS", "S", "M", "L", "XL"}
+
+// frameSize maps a rider's height in inches to a frame size.  Unknown
+// heights map to the empty string.
+func frameSize(height int) string {
+	switch {
+	case height <= 0:
+		return ""
+	case height < 60: // under 5'0
+		return "XS"
+	case height < 65: // under 5'5
+		return "S"
+	case height < 70: // under 5'10
+		return "M"
+	case height < 74: // under 6'2
+		return "L"
+	default:
+		return "XL"
+	}
+}
+
+// parseHeights is the inverse of heightsString.  Heights outside the
+// range heightsString can represent come back as 55 or 79 inches, and
+// unknown heights as -1.
+func parseHeights(s string) []Rider {
+	var riders []Rider
+	for _, f := range strings.Fields(s) {
+		if len(f) < 2 {
+			continue
+		}
+		r := Rider{Gender: f[:1], Height: -1}
+		switch h := f[1:]; {
+		case h == "<4'8":
+			r.Height = 55
+		case h == ">6'6":
+			r.Height = 79
+		default:
+			if i := strings.Index(h, "'"); i > 0 {
+				feet, err1 := strconv.Atoi(h[:i])
+				inches, err2 := strconv.Atoi(h[i+1:])
+				if err1 == nil && err2 == nil {
+					r.Height = feet*12 + inches
+				}
+			}
+		}
+		riders = append(riders, r)
+	}
+	return riders
+}
+
+// BikeShortage is a frame size for which a tour time needs more bikes
+// than its location has.
+type BikeShortage struct {
+	Size   string
+	Stock  int
+	Demand int
+}
+
+// bikeShortages compares the bikes needed by riders against stock,
+// which maps frame sizes to counts.
+func bikeShortages(stock map[string]int, riders []Rider) []*BikeShortage {
+	demand := make(map[string]int)
+	for _, r := range riders {
+		if size := frameSize(r.Height); size != "" {
+			demand[size]++
+		}
+	}
+	var shortages []*BikeShortage
+	for _, size := range frameSizes {
+		if demand[size] > stock[size] {
+			shortages = append(shortages, &BikeShortage{size, stock[size], demand[size]})
+		}
+	}
+	return shortages
+}
+
+// checkBikes returns the frame sizes that the tour's location will run
+// out of once riders from the given order are added to everyone else
+// booked at the same time and location.  Locations without any
+// inventory on record are not checked.
+func (s *Server) checkBikes(ctx context.Context, tourDetail *TourDetail, orderID int32, riders []Rider, warnings map[warning]bool) []*BikeShortage {
+	stock, err := s.store.GetBikeStock(ctx, tourDetail.ConfCode)
+	if err != nil {
+		s.log.Printf("GetBikeStock: %v", err)
+		warnings[WarningGetBikes] = true
+		return nil
+	}
+	if len(stock) == 0 {
+		return nil
+	}
+	booked, err := s.store.GetBookedRiders(ctx, tourDetail.ConfCode, tourDetail.Time, orderID)
+	if err != nil {
+		s.log.Printf("GetBookedRiders: %v", err)
+		warnings[WarningGetBikes] = true
+		return nil
+	}
+	shortages := bikeShortages(stock, append(booked, riders...))
+	if len(shortages) > 0 {
+		warnings[WarningBikesShort] = true
+	}
+	return shortages
+}
+
+// shortageSizes returns the sizes in shortages, e.g. "L,XL".
+func shortageSizes(shortages []*BikeShortage) string {
+	var sizes []string
+	for _, s := range shortages {
+		sizes = append(sizes, s.Size)
+	}
+	return strings.Join(sizes, ",")
+}
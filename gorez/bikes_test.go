@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFrameSize(t *testing.T) {
+	tests := []struct {
+		height int
+		want   string
+	}{
+		{-1, ""},
+		{0, ""},
+		{55, "XS"},
+		{59, "XS"},
+		{60, "S"},
+		{64, "S"},
+		{65, "M"},
+		{69, "M"},
+		{70, "L"},
+		{73, "L"},
+		{74, "XL"},
+		{79, "XL"},
+	}
+	for _, tt := range tests {
+		if got := frameSize(tt.height); got != tt.want {
+			t.Errorf("frameSize(%d) = %q, want %q", tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestBikeShortages(t *testing.T) {
+	riders := []Rider{{Gender: "F", Height: 58}, {Gender: "M", Height: 72}, {Gender: "M", Height: 73}, {Gender: "M", Height: 76}, {Gender: "F", Height: -1}}
+	tests := []struct {
+		name  string
+		stock map[string]int
+		want  []*BikeShortage
+	}{
+		{"enough", map[string]int{"XS": 1, "L": 2, "XL": 1}, nil},
+		{"short", map[string]int{"XS": 1, "L": 1}, []*BikeShortage{{"L", 1, 2}, {"XL", 0, 1}}},
+		{"unknown height needs no bike", map[string]int{"XS": 1, "S": 0, "M": 0, "L": 2, "XL": 1}, nil},
+		{"no stock", nil, []*BikeShortage{{"XS", 0, 1}, {"L", 0, 2}, {"XL", 0, 1}}},
+	}
+	for _, tt := range tests {
+		if got := bikeShortages(tt.stock, riders); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: bikeShortages = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShortageSizes(t *testing.T) {
+	if got := shortageSizes([]*BikeShortage{{"L", 1, 2}, {"XL", 0, 1}}); got != "L,XL" {
+		t.Errorf("shortageSizes = %q, want %q", got, "L,XL")
+	}
+	if got := shortageSizes(nil); got != "" {
+		t.Errorf("shortageSizes(nil) = %q, want %q", got, "")
+	}
+}
+
+func TestParseHeights(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []Rider
+	}{
+		{"", nil},
+		{"F5'4 M6'0", []Rider{{Gender: "F", Height: 64}, {Gender: "M", Height: 72}}},
+		{"F<4'8 M>6'6", []Rider{{Gender: "F", Height: 55}, {Gender: "M", Height: 79}}},
+		{"F?? Mtall X", []Rider{{Gender: "F", Height: -1}, {Gender: "M", Height: -1}}},
+		{"  M5'11   ", []Rider{{Gender: "M", Height: 71}}},
+	}
+	for _, tt := range tests {
+		if got := parseHeights(tt.s); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHeights(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseHeightsRoundTrip(t *testing.T) {
+	riders := []Rider{{Gender: "F", Height: 56}, {Gender: "M", Height: 78}, {Gender: "F", Height: 55}, {Gender: "M", Height: 79}, {Gender: "M", Height: -1}}
+	if got := parseHeights(heightsString(riders)); !reflect.DeepEqual(got, riders) {
+		t.Errorf("parseHeights(heightsString(%v)) = %v", riders, got)
+	}
+}
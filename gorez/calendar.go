@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CalendarVars represents the form inputs.
+type CalendarVars struct {
+	TourID int32 `schema:"TourId"`
+}
+
+func (s *Server) calendar(r *http.Request) (*TourDetail, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if err := r.ParseForm(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars CalendarVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	tourDetail, ok, err := s.store.GetTourDetailByID(r.Context(), vars.TourID, maxRiders)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourDetailByID: %v", err)}
+	}
+	if !ok || tourDetail.Deleted {
+		return nil, warnings, &appError{http.StatusNotFound, fmt.Sprintf("Invalid tour ID %d", vars.TourID), nil}
+	}
+	if tourDetail.Cancelled {
+		warnings[WarningTourCancelled] = true
+	}
+	return tourDetail, warnings, nil
+}
+
+// HandleCalendar serves a tour as an iCalendar event, linked from the
+// confirmation page.
+func (s *Server) HandleCalendar(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	tourDetail, warnings, e := s.calendar(r)
+	if e != nil {
+		if e.Error != nil {
+			s.log.Printf("%v", e.Error)
+		}
+		http.Error(w, e.Message, e.Code)
+		return e.Code, warnings, e.Message
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s.ics\"", tourDetail.Code, tourDetail.Time.Format("2006-01-02")))
+	w.Write([]byte(tourEvent(tourDetail, time.Now())))
+	return http.StatusOK, warnings, fmt.Sprintf("tour:%d", tourDetail.ID)
+}
+
+// tourEvent returns an iCalendar (RFC 5545) file holding one event for
+// the tour.  Times are given in UTC, which needs no VTIMEZONE block;
+// calendar apps show them in the reader's own zone.
+func tourEvent(tourDetail *TourDetail, now time.Time) string {
+	const layout = "20060102T150405Z"
+	status := "CONFIRMED"
+	if tourDetail.Cancelled {
+		status = "CANCELLED"
+	}
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Bike the Big Apple//gorez//EN",
+		"METHOD:PUBLISH",
+		"BEGIN:VEVENT",
+		fmt.Sprintf("UID:tour-%d@bikethebigapple.com", tourDetail.ID),
+		"DTSTAMP:" + now.UTC().Format(layout),
+		"DTSTART:" + tourDetail.Time.UTC().Format(layout),
+		"DTEND:" + tourDetail.Time.Add(assumedTourLength).UTC().Format(layout),
+		"SUMMARY:" + icsEscape(fmt.Sprintf("Bike the Big Apple: %s", tourDetail.LongName)),
+		"DESCRIPTION:" + icsEscape(fmt.Sprintf("Tour %s, %s (%s)", tourDetail.Code, tourDetail.Time.Format("Monday, 2 January 2006 at 3:04 pm"), tourDetail.Time.Location())),
+		"STATUS:" + status,
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(icsFold(line))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+// icsEscape escapes text property values.
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// icsFold splits content lines longer than 75 octets, without
+// breaking UTF-8 sequences.
+func icsFold(line string) string {
+	const max = 75
+	var b strings.Builder
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > max {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	return b.String()
+}
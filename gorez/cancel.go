@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+const (
+	RemedyRefund     = "refund"
+	RemedyReschedule = "reschedule"
+
+	defaultRescheduleURL = "https://bikethebigapple.com/"
+)
+
+// AdminCancelVars represents the form inputs.
+type AdminCancelVars struct {
+	TourID        int32 `schema:"TourId"`
+	Reason        string
+	Remedy        string
+	RescheduleURL string
+	Confirm       bool
+	CSRFToken     string
+}
+
+// CancelResult is the outcome of cancelling one order.
+type CancelResult struct {
+	Order  *Order
+	Refund string
+	Email  string
+	SMS    string
+	OK     bool
+}
+
+// AdminCancelData is the data passed to the admin cancel template.
+type AdminCancelData struct {
+	Page
+	TourDetail    *TourDetail
+	CSRFToken     string // also set in a cookie
+	NumOrders     int
+	Reason        string
+	Remedy        string
+	RescheduleURL string
+	SMSEnabled    bool
+	Results       []*CancelResult // nil until the tour is cancelled
+	NumOK         int
+}
+
+// CancellationData is the data passed to the cancellation email
+// template and cancellationSMS.
+type CancellationData struct {
+	Order         *Order
+	TourDetail    *TourDetail
+	Reason        string
+	Refunded      bool
+	RefundAmount  string // e.g. "$98.00"; empty unless refunded
+	RefundByHand  bool   // no charge on record, so the office refunds it
+	RescheduleURL string // empty if a refund was offered
+}
+
+func (s *Server) adminCancel(r *http.Request) (*AdminCancelData, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if !s.isAdmin(r) {
+		return nil, warnings, &appError{http.StatusUnauthorized, "Unauthorized", nil}
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars AdminCancelVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	token, e := adminCSRF(r, vars.CSRFToken)
+	if e != nil {
+		return nil, warnings, e
+	}
+	tourDetail, ok, err := s.store.GetTourDetailByID(r.Context(), vars.TourID, maxRiders)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourDetailByID: %v", err)}
+	}
+	if !ok {
+		return nil, warnings, &appError{http.StatusBadRequest, fmt.Sprintf("Invalid tour ID %d", vars.TourID), nil}
+	}
+	orders, err := s.store.GetTourOrders(r.Context(), vars.TourID)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourOrders: %v", err)}
+	}
+	data := &AdminCancelData{
+		Page:          staffPage(r),
+		TourDetail:    tourDetail,
+		CSRFToken:     token,
+		NumOrders:     len(orders),
+		Reason:        strings.TrimSpace(vars.Reason),
+		Remedy:        vars.Remedy,
+		RescheduleURL: strings.TrimSpace(vars.RescheduleURL),
+		SMSEnabled:    s.sms != nil,
+	}
+	if data.Remedy == "" {
+		data.Remedy = RemedyRefund
+	}
+	if data.RescheduleURL == "" {
+		data.RescheduleURL = defaultRescheduleURL
+	}
+	if r.Method != "POST" || !vars.Confirm {
+		return data, warnings, nil
+	}
+	switch {
+	case data.Reason == "":
+		return nil, warnings, &appError{http.StatusBadRequest, "Please give a reason for the cancellation", nil}
+	case data.Remedy != RemedyRefund && data.Remedy != RemedyReschedule:
+		return nil, warnings, &appError{http.StatusBadRequest, fmt.Sprintf("Invalid remedy %q", data.Remedy), nil}
+	}
+
+	if !tourDetail.Cancelled {
+		if err := s.store.UpdateTourCancelled(r.Context(), vars.TourID); err != nil {
+			return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("UpdateTourCancelled: %v", err)}
+		}
+		tourDetail.Cancelled = true
+	}
+	var payments map[int32]*Payment
+	if data.Remedy == RemedyRefund {
+		payments, err = s.store.GetTourPayments(r.Context(), vars.TourID)
+		if err != nil {
+			return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourPayments: %v", err)}
+		}
+	}
+	// Orders being worked on finish even if the admin closes the page,
+	// so no refund goes unrecorded.  Orders not reached by bulkDeadline
+	// are left for the admin to run the cancellation again.
+	ctx := context.WithoutCancel(r.Context())
+	instance := "admin@" + instanceName()
+	data.Results = make([]*CancelResult, len(orders))
+	done := forEachOrder(orders, func(i int, order *Order) {
+		data.Results[i] = s.cancelOrder(ctx, order, payments[order.ID], data, instance)
+	})
+	for i, order := range orders {
+		if !done[i] {
+			data.Results[i] = &CancelResult{Order: order, Refund: outOfTime, Email: "-", SMS: "-"}
+		}
+		if data.Results[i].OK {
+			data.NumOK++
+		}
+	}
+	return data, warnings, nil
+}
+
+// cancelOrder refunds an order if a refund is on offer, then tells the
+// customer.  It's safe to repeat: a charge is only refunded once, and
+// the notice is claimed in OrderNotices so customers who were already
+// told aren't told again.
+func (s *Server) cancelOrder(ctx context.Context, order *Order, payment *Payment, data *AdminCancelData, instance string) *CancelResult {
+	result := &CancelResult{Order: order, OK: true}
+	cd := &CancellationData{
+		Order:      order,
+		TourDetail: data.TourDetail,
+		Reason:     data.Reason,
+	}
+	switch {
+	case data.Remedy == RemedyReschedule:
+		cd.RescheduleURL = data.RescheduleURL
+		result.Refund = "not offered"
+	case payment == nil:
+		// Orders paid before OrderPayments existed, or not on the
+		// web.  The customer is told the office will refund them.
+		cd.RefundByHand = true
+		result.Refund, result.OK = "no charge on record; refund by hand", false
+	case payment.RefundID != "":
+		cd.Refunded = true
+		result.Refund = "already refunded " + payment.RefundedAt.Format("Jan 2 3:04pm")
+	default:
+		refundID, err := s.payments.Refund(ctx, order.ID, payment.ChargeID)
+		if err != nil {
+			s.log.Printf("Error refunding order %d: %v", order.ID, err)
+			result.Refund, result.OK = fmt.Sprintf("failed: %v", err), false
+			break
+		}
+		if err := s.store.UpdatePaymentRefunded(ctx, order.ID, refundID, time.Now()); err != nil {
+			s.log.Printf("UpdatePaymentRefunded(%d): %v", order.ID, err)
+		}
+		cd.Refunded = true
+		result.Refund = "refunded"
+	}
+	if cd.Refunded {
+		cd.RefundAmount = fmt.Sprintf("$%d.%02d", payment.Amount/100, payment.Amount%100)
+	}
+
+	// Don't promise a refund that failed; running this again retries it.
+	if data.Remedy == RemedyRefund && !cd.Refunded && !cd.RefundByHand {
+		result.Email, result.SMS = "held until refunded", "held until refunded"
+		return result
+	}
+	now := time.Now()
+	claimed, err := s.store.ClaimNotice(ctx, order.ID, NoticeCancellation, instance, now, now.Add(-noticeClaimTimeout))
+	if err != nil {
+		s.log.Printf("ClaimNotice(%d, %s): %v", order.ID, NoticeCancellation, err)
+		result.Email, result.SMS, result.OK = fmt.Sprintf("failed: %v", err), "-", false
+		return result
+	}
+	if !claimed {
+		result.Email, result.SMS = "already sent", "-"
+		return result
+	}
+	if order.Email == "" {
+		result.Email, result.OK = "no address", false
+	} else if err := s.emailCancellation(ctx, cd); err != nil {
+		s.log.Printf("Error emailing cancellation for order %d: %v", order.ID, err)
+		result.Email, result.OK = fmt.Sprintf("failed: %v", err), false
+	} else {
+		result.Email = "sent"
+	}
+	switch {
+	case order.SMSNumber == "":
+		result.SMS = "not opted in"
+	case s.sms == nil:
+		result.SMS = "texts disabled"
+	default:
+		if err := s.sms.SendSMS(ctx, order.SMSNumber, cancellationSMS(cd)); err != nil {
+			s.log.Printf("Error texting cancellation for order %d: %v", order.ID, err)
+			result.SMS = fmt.Sprintf("failed: %v", err)
+		} else {
+			result.SMS = "sent"
+		}
+	}
+	if result.Email == "sent" || result.SMS == "sent" {
+		if err := s.store.UpdateNoticeSent(ctx, order.ID, NoticeCancellation, time.Now()); err != nil {
+			s.log.Printf("UpdateNoticeSent(%d, %s): %v", order.ID, NoticeCancellation, err)
+		}
+	}
+	return result
+}
+
+func (s *Server) emailCancellation(ctx context.Context, data *CancellationData) error {
+	tmpl, err := s.emailTemplates.Get("cancellation.txt")
+	if err != nil {
+		return fmt.Errorf("load cancellation email template: %v", err)
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return fmt.Errorf("execute cancellation email template: %v", err)
+	}
+	from := mail.NewEmail("Bike the Big Apple reservations", "reservations@bikethebigapple.com")
+	to := mail.NewEmail(data.Order.Name, data.Order.Email)
+	bcc := mail.NewEmail("Bike the Big Apple reservations", "reservations@bikethebigapple.com")
+	subject := fmt.Sprintf("%s Tour %s Bike Tour Cancelled", data.TourDetail.Time.Format("January 2"), data.TourDetail.Code)
+	if err := s.sendEmail(ctx, from, to, bcc, subject, body.String()); err != nil {
+		return fmt.Errorf("send cancellation email: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) HandleAdminCancel(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	data, warnings, e := s.adminCancel(r)
+	if e != nil {
+		s.handleAdminError(w, e)
+		return e.Code, warnings, e.Message
+	}
+	summary = fmt.Sprintf("tour:%d", data.TourDetail.ID)
+	if data.Results != nil {
+		summary += fmt.Sprintf(" remedy:%s ok:%d/%d", data.Remedy, data.NumOK, len(data.Results))
+	}
+	tmpl, err := s.templates.Get("admin_cancel.html")
+	if err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error parsing admin cancel template"
+	}
+	s.setCSRFCookie(w, data.CSRFToken)
+	if err := tmpl.Execute(w, data); err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error executing admin cancel template"
+	}
+	return http.StatusOK, warnings, summary
+}
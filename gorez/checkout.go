@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"path"
 	"time"
 )
 
@@ -14,7 +13,8 @@ const (
 
 // CheckoutVars represents the form inputs.
 type CheckoutVars struct {
-	TourID int32 `schema:"TourId"`
+	TourID int32  `schema:"TourId"`
+	Lang   string `schema:"lang"` // read by language
 }
 
 type NumRidersOption struct {
@@ -22,19 +22,39 @@ type NumRidersOption struct {
 	Display int
 }
 
+// HeightOption is one choice of rider height, in inches.
+type HeightOption struct {
+	Inches  int
+	Display string // e.g. "5′04″ (163 cm)"
+}
+
+func heightOptions() []*HeightOption {
+	var options []*HeightOption
+	for in := minHeight; in <= maxHeight; in++ {
+		cm := int(float64(in)*2.54 + 0.5)
+		options = append(options, &HeightOption{in, fmt.Sprintf("%d′%02d″ (%d cm)", in/12, in%12, cm)})
+	}
+	return options
+}
+
 // CheckoutData is the data passed to the template.
 type CheckoutData struct {
 	TourDetail           *TourDetail
+	PriceCents           int64
 	NumRidersOptions     []*NumRidersOption
+	HeightOptions        []*HeightOption
 	ExpiryYearOptions    []int
 	StripePublishableKey template.JSStr
+	CSRFToken            string // also set in a cookie
+	Checkout             string // signed CheckoutPayload
+	Challenge            string // puzzle for suspicious clients, else empty
 	Warnings             map[warning]bool
-	GoogleTrackingID     string
+	Page
 }
 
 type CheckoutErrorData struct {
-	Error            string
-	GoogleTrackingID string
+	Error string
+	Page
 }
 
 func (s *Server) checkout(r *http.Request) (*CheckoutData, map[warning]bool, *appError) {
@@ -50,7 +70,7 @@ func (s *Server) checkout(r *http.Request) (*CheckoutData, map[warning]bool, *ap
 		return nil, warnings, &appError{http.StatusBadRequest, "Please return to the previous page and select a date. Thank you.", nil}
 	}
 
-	tourDetail, ok, err := s.store.GetTourDetailByID(vars.TourID, maxRiders)
+	tourDetail, ok, err := s.store.GetTourDetailByID(r.Context(), vars.TourID, maxRiders)
 	if err != nil {
 		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourDetailByID: %v", err)}
 	}
@@ -87,13 +107,27 @@ func (s *Server) checkout(r *http.Request) (*CheckoutData, map[warning]bool, *ap
 	for y := thisYear; y < thisYear+futureYears; y++ {
 		expiryYearOptions = append(expiryYearOptions, y)
 	}
+	token, err := csrfToken(r)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("csrfToken: %v", err)}
+	}
+	puzzle, err := s.guard.Puzzle(s.clientIP(r), time.Now())
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("Puzzle: %v", err)}
+	}
+	priceCents := int64(tourDetail.Price*100 + 0.5)
 	data := &CheckoutData{
 		TourDetail:           tourDetail,
+		PriceCents:           priceCents,
 		NumRidersOptions:     numRidersOptions,
+		HeightOptions:        heightOptions(),
 		ExpiryYearOptions:    expiryYearOptions,
 		StripePublishableKey: template.JSStr(s.stripePublishableKey),
+		CSRFToken:            token,
+		Checkout:             s.checkoutPayload(&CheckoutPayload{tourDetail.ID, priceCents, time.Now()}),
+		Challenge:            puzzle,
 		Warnings:             warnings,
-		GoogleTrackingID:     s.googleTrackingID,
+		Page:                 s.localizedPage(r),
 	}
 	return data, warnings, nil
 }
@@ -104,26 +138,27 @@ func (s *Server) HandleCheckout(w http.ResponseWriter, r *http.Request) (code in
 		if e.Error != nil {
 			s.log.Printf("%s: %v", e.Message, e.Error)
 		}
-		tmpl, err := template.ParseFiles(path.Join(s.templatesDir, "checkout_error.html"))
+		tmpl, err := s.templates.Get("checkout_error.html")
 		if err != nil {
 			s.log.Printf("%v", err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return http.StatusInternalServerError, warnings, "Error parsing checkout error template"
 		}
 		w.WriteHeader(e.Code)
-		if err := tmpl.Execute(w, &CheckoutErrorData{e.Message, s.googleTrackingID}); err != nil {
+		if err := tmpl.Execute(w, &CheckoutErrorData{Page: s.page(r), Error: e.Message}); err != nil {
 			s.log.Printf("%v", err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return http.StatusInternalServerError, warnings, "Error executing checkout error template"
 		}
 		return e.Code, warnings, e.Message
 	}
-	tmpl, err := template.ParseFiles(path.Join(s.templatesDir, "checkout.html"))
+	tmpl, err := s.templates.Get("checkout.html")
 	if err != nil {
 		s.log.Printf("%v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return http.StatusInternalServerError, warnings, "Error parsing checkout template"
 	}
+	s.setCSRFCookie(w, data.CSRFToken)
 	if err := tmpl.Execute(w, data); err != nil {
 		s.log.Printf("%v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
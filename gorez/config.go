@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings come from, in increasing order of precedence: the flag
+// defaults, the YAML file named by -config (a map from flag names to
+// values), environment variables named GOREZ_ and the flag name in
+// upper case (e.g. GOREZ_STRIPE_SECRET_KEY), and the command line.
+// Each secret can instead be read from a file named by the flag with
+// "_file" appended, e.g. -stripe_secret_key_file=/run/secrets/stripe,
+// so that it doesn't show up in ps.
+
+var configFile = flag.String("config", "", "YAML file of settings keyed by flag name")
+
+const envPrefix = "GOREZ_"
+
+// secretFlags are the flags that can also be read from a file.
+var secretFlags = []string{
+	"bookings_dsn",
+	"sendgrid_key",
+	"stripe_secret_key",
+	"admin_password",
+	"signing_key",
+	"sms_password",
+}
+
+func init() {
+	for _, name := range secretFlags {
+		flag.String(name+"_file", "", "file holding -"+name)
+	}
+}
+
+// Config holds the server's settings.
+type Config struct {
+	Port                  int
+	BookingsDSN           string
+	SendgridKey           string
+	StripeSecretKey       string
+	StripePublishableKey  string
+	TemplatesDir          string // empty means the embedded templates
+	EmailTemplatesDir     string
+	RequestLog            string // empty means stdout
+	DebugLog              string // empty means stdout
+	GoogleTrackingID      string
+	GoogleConversionID    int
+	GoogleConversionLabel string
+	AdminPassword         string
+	SigningKey            string
+	BaseURL               string
+	SMSAPIURL             string // empty disables texts
+	SMSUser               string
+	SMSPassword           string
+	SMSFrom               string
+	SchedulerInterval     time.Duration
+	ReminderLead          time.Duration
+	FollowupDelay         time.Duration
+	Dev                   bool
+	RidersPerTeam         string
+	ReconcileInterval     time.Duration
+	ReconcileLookback     time.Duration
+	AlertRules            string
+	AlertEmail            string
+	AlertWebhook          string
+	AlertCooldown         time.Duration
+	AlertMaxPerHour       int
+	ShutdownDelay         time.Duration
+	ShutdownTimeout       time.Duration
+	TourTimeZone          string
+	CheckoutIPLimit       string
+	CheckoutEmailLimit    string
+	DeclineLimit          string
+	DeclineBlock          time.Duration
+	ChallengeBits         int // 0 disables the challenge
+	TrustedProxies        string
+	CSPReportOnly         bool
+}
+
+// loadConfig merges the config file and environment into the flags,
+// which must already be parsed, and returns the validated result.
+func loadConfig() (*Config, error) {
+	onCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+
+	path := *configFile
+	if !onCommandLine["config"] {
+		if env := os.Getenv(envPrefix + "CONFIG"); env != "" {
+			path = env
+		}
+	}
+	fromFile := make(map[string]string)
+	if path != "" {
+		var err error
+		if fromFile, err = readConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+	var errs []error
+	flag.VisitAll(func(f *flag.Flag) {
+		if onCommandLine[f.Name] || f.Name == "config" {
+			return
+		}
+		value, ok := os.LookupEnv(envPrefix + strings.ToUpper(f.Name))
+		source := envPrefix + strings.ToUpper(f.Name)
+		if !ok {
+			value, ok = fromFile[f.Name]
+			source = path
+		}
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid %s %q: %v", source, f.Name, value, err))
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if err := readSecretFiles(); err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		Port:                  *port,
+		BookingsDSN:           *bookingsDSN,
+		SendgridKey:           *sendgridKey,
+		StripeSecretKey:       *stripeSecretKey,
+		StripePublishableKey:  *stripePublishableKey,
+		TemplatesDir:          *templatesDir,
+		EmailTemplatesDir:     *emailTemplatesDir,
+		RequestLog:            *requestLog,
+		DebugLog:              *debugLog,
+		GoogleTrackingID:      *googleTrackingID,
+		GoogleConversionID:    *googleConversionID,
+		GoogleConversionLabel: *googleConversionLabel,
+		AdminPassword:         *adminPassword,
+		SigningKey:            *signingKey,
+		BaseURL:               *baseURL,
+		SMSAPIURL:             *smsAPIURL,
+		SMSUser:               *smsUser,
+		SMSPassword:           *smsPassword,
+		SMSFrom:               *smsFrom,
+		SchedulerInterval:     *schedulerInterval,
+		ReminderLead:          *reminderLead,
+		FollowupDelay:         *followupDelay,
+		Dev:                   *devMode,
+		RidersPerTeam:         *ridersPerTeam,
+		ReconcileInterval:     *reconcileInterval,
+		ReconcileLookback:     *reconcileLookback,
+		AlertRules:            *alertRules,
+		AlertEmail:            *alertEmail,
+		AlertWebhook:          *alertWebhook,
+		AlertCooldown:         *alertCooldown,
+		AlertMaxPerHour:       *alertMaxPerHour,
+		ShutdownDelay:         *shutdownDelay,
+		ShutdownTimeout:       *shutdownTimeout,
+		TourTimeZone:          *tourTimeZone,
+		CheckoutIPLimit:       *checkoutIPLimit,
+		CheckoutEmailLimit:    *checkoutEmailLimit,
+		DeclineLimit:          *declineLimit,
+		DeclineBlock:          *declineBlock,
+		ChallengeBits:         *challengeBits,
+		TrustedProxies:        *trustedProxies,
+		CSPReportOnly:         *cspReportOnly,
+	}
+	if cfg.Dev && cfg.TemplatesDir == "" {
+		cfg.TemplatesDir = "templates"
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readConfigFile reads a YAML map of flag names to values.  Lists are
+// joined with commas, e.g. for alert_email.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := make(map[string]string)
+	for name, v := range raw {
+		if f := flag.Lookup(name); f == nil || name == "config" {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		switch v := v.(type) {
+		case nil:
+			values[name] = ""
+		case []interface{}:
+			var items []string
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("%s: %s must be a value or a list", path, name)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// readSecretFiles sets each secret flag from its file, if one is
+// named.
+func readSecretFiles() error {
+	for _, name := range secretFlags {
+		path := flag.Lookup(name + "_file").Value.String()
+		if path == "" {
+			continue
+		}
+		if flag.Lookup(name).Value.String() != "" {
+			return fmt.Errorf("both %s and %s_file are set", name, name)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_file: %v", name, err)
+		}
+		if err := flag.Set(name, strings.TrimSpace(string(b))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate reports every problem with the settings at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Port > 0 && c.Port < 65536, "port %d out of range", c.Port)
+	if c.BookingsDSN == "" {
+		errs = append(errs, errors.New("bookings_dsn is required"))
+	} else if dsn, err := mysql.ParseDSN(c.BookingsDSN); err != nil {
+		errs = append(errs, fmt.Errorf("bookings_dsn: %v", err))
+	} else if dsn.Loc != nil && dsn.Loc.String() != "UTC" {
+		errs = append(errs, fmt.Errorf("bookings_dsn: loc=%s is not supported; gorez stores times as UTC clock readings, so leave loc out or set loc=UTC", dsn.Loc))
+	}
+	if !c.Dev {
+		check(c.StripeSecretKey != "", "stripe_secret_key is required")
+		check(c.StripePublishableKey != "", "stripe_publishable_key is required")
+		check(c.SendgridKey != "", "sendgrid_key is required")
+		// Checkout forms and challenges must verify on every
+		// instance and after a restart.
+		check(c.SigningKey != "", "signing_key is required")
+	}
+	check(c.GoogleConversionID >= 0, "google_conversion_id must not be negative")
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "base_url %q is not an absolute http(s) URL", c.BaseURL)
+	}
+	check(c.SigningKey == "" || c.BaseURL != "", "base_url is required with signing_key, for links in emails")
+	if c.SMSAPIURL != "" {
+		_, ok := normalizePhone(c.SMSFrom)
+		check(ok, "sms_from %q is not a phone number", c.SMSFrom)
+	}
+	if c.AlertWebhook != "" {
+		u, err := url.Parse(c.AlertWebhook)
+		check(err == nil && u.Host != "", "alert_webhook %q is not a URL", c.AlertWebhook)
+	}
+	check(c.SchedulerInterval > 0, "scheduler_interval must be positive")
+	check(c.ReminderLead >= 0, "reminder_lead must not be negative")
+	check(c.FollowupDelay >= 0, "followup_delay must not be negative")
+	check(c.ReconcileInterval >= 0, "reconcile_interval must not be negative")
+	check(c.ReconcileLookback > 0, "reconcile_lookback must be positive")
+	check(c.AlertCooldown >= 0, "alert_cooldown must not be negative")
+	check(c.AlertMaxPerHour > 0, "alert_max_per_hour must be positive")
+	check(c.ShutdownDelay >= 0, "shutdown_delay must not be negative")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	if _, err := parseTeamRatios(c.RidersPerTeam); err != nil {
+		errs = append(errs, fmt.Errorf("riders_per_team: %v", err))
+	}
+	if _, err := parseAlertRules(c.AlertRules); err != nil {
+		errs = append(errs, fmt.Errorf("alert_rules: %v", err))
+	}
+	if _, err := time.LoadLocation(c.TourTimeZone); err != nil {
+		errs = append(errs, fmt.Errorf("tour_time_zone: %v", err))
+	}
+	for _, l := range []struct{ name, value string }{
+		{"checkout_ip_limit", c.CheckoutIPLimit},
+		{"checkout_email_limit", c.CheckoutEmailLimit},
+		{"decline_limit", c.DeclineLimit},
+	} {
+		if _, err := parseRateLimit(l.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", l.name, err))
+		}
+	}
+	check(c.DeclineBlock >= 0, "decline_block must not be negative")
+	check(c.ChallengeBits >= 0 && c.ChallengeBits <= 32, "challenge_bits must be between 0 and 32")
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %v", err))
+	}
+	return errors.Join(errs...)
+}
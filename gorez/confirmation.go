@@ -2,34 +2,43 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"html/template"
 	"net/http"
-	"path"
 	"strconv"
 	"strings"
 	"time"
 
-	texttemplate "text/template"
-
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
-	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/charge"
-	"github.com/stripe/stripe-go/customer"
 )
 
 type RiderVars struct {
 	Gender string
 	Height int
+	Name   string
+	Age    int
 }
 
+const maxAge = 120
+
+// Rider heights in inches must be within the range the checkout form
+// offers, or unknown.
+const (
+	minHeight = 36
+	maxHeight = 84
+)
+
 // ConfirmationVars represents the form inputs.
 type ConfirmationVars struct {
 	TourID      int32
 	NumRiders   int
 	Riders      []RiderVars
 	QuotedTotal float64
+	CSRFToken   string
+	Checkout    string // signed CheckoutPayload
+	Proof       string // answer to the challenge, if any
 
 	Name        string
 	StripeToken string
@@ -38,14 +47,22 @@ type ConfirmationVars struct {
 	Mobile string
 	Hotel  string
 	Misc   string
+
+	EmergencyName  string
+	EmergencyPhone string
+	SMSOptIn       bool
+
+	Lang string `schema:"lang"` // read by language
 }
 
 // ConfirmationData is the data passed to the templates for the
 // customer email, BTBA email, and web response.
 type ConfirmationData struct {
 	TourDetail   *TourDetail
+	OrderID      int32
 	NumRiders    int
-	DisplayTotal string
+	TotalCents   int64
+	DisplayTotal string // in English; in the customer's language in their email
 
 	Name   string
 	Email  string
@@ -53,10 +70,18 @@ type ConfirmationData struct {
 	Hotel  string
 	Misc   string
 
+	// Staff only; cleared before emailing the customer.
+	Riders    []Rider
+	Emergency EmergencyContact
+
+	SMSNumber string // E.164; empty unless opted in to texts
+
+	WaiverLinks []*WaiverLink // empty if waivers are disabled
+
 	Warnings     map[warning]bool
 	EmailSkipped string // empty if customer email sent
 
-	GoogleTrackingID      string
+	Page                  // Lang is also the customer email's language
 	GoogleConversionID    template.JS
 	GoogleConversionLabel string
 	GoogleConversionValue template.JS
@@ -65,13 +90,16 @@ type ConfirmationData struct {
 
 	NewTotalRiders int
 	Teams          []*Team
+	TeamsNeeded    int  // for NewTotalRiders
+	TeamAdded      bool // this booking pushed the tour over a team threshold
+	BikeShortages  []*BikeShortage
 	BTBARef        string // value of BTBARef cookie, may be empty
 }
 
 type ConfirmationErrorData struct {
-	Code             int
-	Error            string
-	GoogleTrackingID string
+	Code  int
+	Error string
+	Page
 }
 
 var knownConfCodes = map[string]bool{
@@ -111,6 +139,38 @@ func (s *Server) confirm(r *http.Request) (*ConfirmationData, map[warning]bool,
 		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
 	}
 
+	// Reject forms posted from other sites, and forms whose tour has
+	// been changed since the checkout page was served.
+	if !checkCSRF(r, vars.CSRFToken) {
+		warnings[WarningCSRF] = true
+		return nil, warnings, &appError{http.StatusForbidden, "Your checkout session has expired", fmt.Errorf("CSRF token missing or doesn't match cookie")}
+	}
+	checkout, err := s.parseCheckoutPayload(vars.Checkout, time.Now())
+	if err != nil {
+		warnings[WarningFormTampered] = true
+		return nil, warnings, &appError{http.StatusForbidden, "This checkout form has expired or been altered", err}
+	}
+	if checkout.TourID != vars.TourID {
+		warnings[WarningFormTampered] = true
+		return nil, warnings, &appError{http.StatusForbidden, "This checkout form has been altered", fmt.Errorf("form TourID=%d, signed TourID=%d", vars.TourID, checkout.TourID)}
+	}
+
+	// Slow down card testing.  The challenge is checked first, on the
+	// same terms as when the checkout page was served.
+	ip, now := s.clientIP(r), time.Now()
+	passed, err := s.guard.CheckChallenge(r.Context(), ip, vars.Proof, now)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("CheckChallenge: %v", err)}
+	}
+	if !passed {
+		warnings[WarningChallengeFailed] = true
+		return nil, warnings, &appError{http.StatusForbidden, "Please complete the security check", nil}
+	}
+	if w := s.guard.Attempt(ip, vars.Email, now); w != "" {
+		warnings[w] = true
+		return nil, warnings, &appError{http.StatusTooManyRequests, "Too many attempts", fmt.Errorf("%s ip=%s", w, ip)}
+	}
+
 	// Look up requested tour.
 	//
 	// NOTE: These checks are racy, but the conditions are unlikely.
@@ -119,13 +179,19 @@ func (s *Server) confirm(r *http.Request) (*ConfirmationData, map[warning]bool,
 	// - Tour number of riders changed (due to concurrent purchase)
 	// We could do the reads/checks/write in a transaction, retrying
 	// when the commit fails due to a change in the number of riders.
-	tourDetail, ok, err := s.store.GetTourDetailByID(vars.TourID, maxRiders)
+	ctx := r.Context()
+	tourDetail, ok, err := s.store.GetTourDetailByID(ctx, vars.TourID, maxRiders)
 	if err != nil {
 		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourDetailByID: %v", err)}
 	}
 	if !ok {
 		return nil, warnings, &appError{http.StatusBadRequest, fmt.Sprintf("Invalid tour ID %d", vars.TourID), nil}
 	}
+	// Only charge the price the customer was shown.
+	priceCents := int64(tourDetail.Price*100 + 0.5)
+	if priceCents != checkout.PriceCents {
+		return nil, warnings, &appError{http.StatusConflict, "The price of this tour has changed", fmt.Errorf("signed=%d, actual=%d", checkout.PriceCents, priceCents)}
+	}
 	if tourDetail.Time.Before(time.Now()) {
 		warnings[WarningTourPast] = true
 	}
@@ -141,25 +207,39 @@ func (s *Server) confirm(r *http.Request) (*ConfirmationData, map[warning]bool,
 	switch {
 	case vars.NumRiders < 1:
 		return nil, warnings, &appError{http.StatusBadRequest, "NumRiders must be at least 1", nil}
+	case vars.NumRiders > maxRiders:
+		warnings[WarningFormTampered] = true
+		return nil, warnings, &appError{http.StatusBadRequest, fmt.Sprintf("NumRiders must be at most %d", maxRiders), nil}
 	case vars.NumRiders > tourDetail.NumSpotsRemaining:
 		warnings[WarningTourOversubscribed] = true
 	}
 	// Compute totals in cents [float64(13.57) -> uint64(1357)] and validate.
-	actualTotal := int64(float64(vars.NumRiders)*tourDetail.Price*100 + 0.5)
+	actualTotal := int64(vars.NumRiders) * priceCents
 	quotedTotal := int64(vars.QuotedTotal*100 + 0.5)
 	if actualTotal != quotedTotal {
 		return nil, warnings, &appError{http.StatusBadRequest, "Pricing error", fmt.Errorf("quoted=%d, actual=%d", quotedTotal, actualTotal)}
 	}
 
-	// Validate genders & heights.
-	var riders []Rider
-	if tourDetail.HeightsNeeded {
-		if len(vars.Riders) < vars.NumRiders {
-			warnings[WarningInvalidHeights] = true
-		} else {
-			vars.Riders = vars.Riders[:vars.NumRiders]
+	// Validate genders & heights, and tidy the optional names & ages.
+	if len(vars.Riders) > vars.NumRiders {
+		vars.Riders = vars.Riders[:vars.NumRiders]
+	}
+	if tourDetail.HeightsNeeded && len(vars.Riders) < vars.NumRiders {
+		warnings[WarningInvalidHeights] = true
+	}
+	var (
+		riders     []Rider
+		anyDetails bool
+	)
+	for _, r := range vars.Riders {
+		rider := Rider{Name: strings.TrimSpace(r.Name), Age: r.Age}
+		if rider.Age < 0 || rider.Age > maxAge {
+			rider.Age = 0
 		}
-		for _, r := range vars.Riders {
+		if rider.Name != "" || rider.Age > 0 {
+			anyDetails = true
+		}
+		if tourDetail.HeightsNeeded {
 			if r.Gender != "F" && r.Gender != "M" && r.Gender != "X" {
 				r.Gender = "?"
 				warnings[WarningInvalidHeights] = true
@@ -167,11 +247,16 @@ func (s *Server) confirm(r *http.Request) (*ConfirmationData, map[warning]bool,
 			switch {
 			case r.Height < 0:
 				warnings[WarningUnknownHeights] = true
-			case r.Height == 0:
+			case r.Height < minHeight || r.Height > maxHeight:
+				r.Height = 0 // stored as NULL
 				warnings[WarningInvalidHeights] = true
 			}
-			riders = append(riders, Rider{r.Gender, r.Height})
+			rider.Gender, rider.Height = r.Gender, r.Height
 		}
+		riders = append(riders, rider)
+	}
+	if !tourDetail.HeightsNeeded && !anyDetails {
+		riders = nil // nothing worth recording
 	}
 
 	// Trim strings and validate email.
@@ -181,6 +266,13 @@ func (s *Server) confirm(r *http.Request) (*ConfirmationData, map[warning]bool,
 		mobile = strings.TrimSpace(vars.Mobile)
 		hotel  = strings.TrimSpace(vars.Hotel)
 		misc   = strings.TrimSpace(vars.Misc)
+
+		contacts = OrderContacts{
+			Emergency: EmergencyContact{
+				Name:  strings.TrimSpace(vars.EmergencyName),
+				Phone: strings.TrimSpace(vars.EmergencyPhone),
+			},
+		}
 	)
 	if name == "" {
 		warnings[WarningNoName] = true
@@ -188,67 +280,79 @@ func (s *Server) confirm(r *http.Request) (*ConfirmationData, map[warning]bool,
 	if email == "" {
 		warnings[WarningNoEmail] = true
 	}
+	if vars.SMSOptIn {
+		if number, ok := normalizePhone(mobile); ok {
+			contacts.SMSNumber = number
+		} else {
+			warnings[WarningInvalidMobile] = true
+		}
+	}
 
 	// Add order to database.
-	orderID, err := s.store.CreateOrder(vars.TourID, vars.NumRiders, riders, actualTotal, name, email, mobile, hotel, misc)
+	orderID, err := s.store.CreateOrder(ctx, vars.TourID, vars.NumRiders, riders, actualTotal, name, email, mobile, hotel, misc, contacts)
 	if err != nil {
 		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("CreateOrder: %v", err)}
 	}
 
-	// Charge to Stripe.
-	stripe.Key = s.stripeSecretKey
-	customerParams := &stripe.CustomerParams{
-		Description: stripe.String(name),
-		Email:       stripe.String(email),
-		Source:      &stripe.SourceParams{Token: stripe.String(vars.StripeToken)},
-	}
-	customer, err := customer.New(customerParams)
+	// Charge the card.  Once charging starts, the charge and everything
+	// after it must finish even if the customer goes away, or we'd take
+	// their money without recording it or confirming the booking.
+	if err := ctx.Err(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Request cancelled", err}
+	}
+	ctx = context.WithoutCancel(ctx)
+	chargeID, err := s.payments.Charge(ctx, orderID, name, email, vars.StripeToken, actualTotal)
 	if err != nil {
-		if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Code == stripe.ErrorCodeCardDeclined {
-			return nil, warnings, &appError{http.StatusPaymentRequired, stripeErr.Msg, stripeErr}
-		}
-		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("charge.New: %v", err)}
-	}
-	chargeParams := &stripe.ChargeParams{
-		Amount:   stripe.Int64(actualTotal),
-		Currency: stripe.String("USD"),
-		Customer: stripe.String(customer.ID),
-	}
-	chargeParams.AddMetadata("OrderNum", strconv.Itoa(int(orderID)))
-	if _, err = charge.New(chargeParams); err != nil {
-		if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Code == stripe.ErrorCodeCardDeclined {
-			return nil, warnings, &appError{http.StatusPaymentRequired, stripeErr.Msg, stripeErr}
+		if msg, ok := cardDeclined(err); ok {
+			if s.guard.Declined(ip, email, time.Now()) {
+				warnings[WarningCheckoutBlocked] = true
+			}
+			return nil, warnings, &appError{http.StatusPaymentRequired, msg, err}
 		}
-		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("charge.New: %v", err)}
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("Charge: %v", err)}
 	}
 
 	// At this point, checkout has succeeded.  Everything below is
 	// optional.
+	recordBooking(tourDetail.Code, vars.NumRiders, actualTotal)
 
 	// Update order in database to record payment.
-	if err := s.store.UpdateOrderPaymentRecorded(orderID); err != nil {
+	if err := s.store.UpdateOrderPaymentRecorded(ctx, orderID, chargeID, actualTotal); err != nil {
 		s.log.Printf("UpdateOrderPaymentRecorded: %v", err)
 		warnings[WarningPaymentRecorded] = true
 	}
 
+	// Check that the meeting point has enough bikes of each size.
+	var bikeShortages []*BikeShortage
+	if tourDetail.HeightsNeeded {
+		bikeShortages = s.checkBikes(ctx, tourDetail, orderID, riders, warnings)
+	}
+
 	// Gather data for email & web templates.
 	data := &ConfirmationData{
 		TourDetail:            tourDetail,
+		OrderID:               orderID,
 		NumRiders:             vars.NumRiders,
+		TotalCents:            actualTotal,
 		DisplayTotal:          fmt.Sprintf("$%d.%02d", actualTotal/100, actualTotal%100),
 		Name:                  name,
 		Email:                 email,
 		Mobile:                mobile,
 		Hotel:                 hotel,
 		Misc:                  misc,
+		Riders:                riders,
+		Emergency:             contacts.Emergency,
+		SMSNumber:             contacts.SMSNumber,
 		Warnings:              warnings,
-		GoogleTrackingID:      s.googleTrackingID,
+		Page:                  s.localizedPage(r),
 		GoogleConversionID:    template.JS(strconv.Itoa(s.googleConversionID)),
 		GoogleConversionLabel: s.googleConversionLabel,
 		GoogleConversionValue: template.JS(fmt.Sprintf("%d.%02d", actualTotal/100, actualTotal%100)),
 		CDATABegin:            template.JS("/* <![CDATA[ */"),
 		CDATAEnd:              template.JS("/* ]]> */"),
 		NewTotalRiders:        tourDetail.TotalRiders + vars.NumRiders,
+		BikeShortages:         bikeShortages,
+		WaiverLinks:           s.waiverLinks(orderID, vars.NumRiders),
 	}
 	if cookie, err := r.Cookie("BTBARef"); err == nil {
 		data.BTBARef = cookie.Value
@@ -259,24 +363,33 @@ func (s *Server) confirm(r *http.Request) (*ConfirmationData, map[warning]bool,
 		data.EmailSkipped = "no auto confirm"
 	} else if skipEmail(warnings) {
 		data.EmailSkipped = fmt.Sprintf("warnings: %v", warningsList(warnings))
-	} else if err := s.emailCustomer(data); err != nil {
+	} else if err := s.emailCustomer(ctx, data); err != nil {
 		data.EmailSkipped = fmt.Sprintf("email send failure: %v", err)
 		s.log.Printf("Error emailing customer: %v", err)
 		warnings[WarningEmailCustomer] = true
 	} else {
 		// Update order in database to record confirmation email.
-		if err := s.store.UpdateOrderConfirmationSent(orderID); err != nil {
+		if err := s.store.UpdateOrderConfirmationSent(ctx, orderID); err != nil {
 			s.log.Printf("UpdateOrderConfirmationSent: %v", err)
 			warnings[WarningConfirmationSent] = true
 		}
 	}
+	// Text the customer, on the same terms as the email.
+	if data.SMSNumber != "" && s.sms != nil && tourDetail.AutoConfirm && !skipEmail(warnings) {
+		if err := s.sms.SendSMS(ctx, data.SMSNumber, bookingSMS(data)); err != nil {
+			s.log.Printf("Error texting customer: %v", err)
+			warnings[WarningSMSCustomer] = true
+		}
+	}
 	// Email BTBA.
-	data.Teams, err = s.store.GetTeams(vars.TourID)
+	data.Teams, err = s.store.GetTeams(ctx, vars.TourID)
 	if err != nil {
 		s.log.Printf("GetTeams: %v", err)
 		warnings[WarningGetTeams] = true
 	}
-	if err := s.emailBTBA(data); err != nil {
+	data.TeamsNeeded = s.teamRatios.teamsNeeded(tourDetail.Code, data.NewTotalRiders)
+	data.TeamAdded = data.TeamsNeeded > s.teamRatios.teamsNeeded(tourDetail.Code, tourDetail.TotalRiders)
+	if err := s.emailBTBA(ctx, data); err != nil {
 		s.log.Printf("Error emailing BTBA: %v", err)
 		warnings[WarningEmailBTBA] = true
 	}
@@ -284,32 +397,41 @@ func (s *Server) confirm(r *http.Request) (*ConfirmationData, map[warning]bool,
 	return data, warnings, nil
 }
 
-func (s *Server) emailCustomer(data *ConfirmationData) error {
+func (s *Server) emailCustomer(ctx context.Context, data *ConfirmationData) error {
 	if !knownConfCodes[data.TourDetail.ConfCode] {
 		return fmt.Errorf("unknown conf code: %s", data.TourDetail.ConfCode)
 	}
-	tmpl, err := texttemplate.ParseFiles(path.Join(s.emailTemplatesDir, "customer.txt"))
+	name := "customer.txt"
+	if s.emailTemplates.Has(localizedName(name, data.Lang)) {
+		name = localizedName(name, data.Lang)
+	}
+	tmpl, err := s.emailTemplates.Get(name)
 	if err != nil {
-		return fmt.Errorf("parse customer email template: %v", err)
+		return fmt.Errorf("load customer email template: %v", err)
 	}
+	// Per-rider details and the emergency contact are for staff only.
+	customerData := *data
+	customerData.Riders = nil
+	customerData.Emergency = EmergencyContact{}
+	customerData.DisplayTotal = data.Money(data.TotalCents)
 	var body bytes.Buffer
-	if err := tmpl.Execute(&body, data); err != nil {
+	if err := tmpl.Execute(&body, &customerData); err != nil {
 		return fmt.Errorf("execute customer email template: %v", err)
 	}
 	from := mail.NewEmail("Bike the Big Apple reservations", "reservations@bikethebigapple.com")
 	to := mail.NewEmail(data.Name, data.Email)
 	bcc := mail.NewEmail("Bike the Big Apple reservations", "reservations@bikethebigapple.com")
-	subject := fmt.Sprintf("%s Tour %s Bike Tour Confirmation", data.TourDetail.Time.Format("January 2"), data.TourDetail.Code)
-	if err := s.sendEmail(from, to, bcc, subject, body.String()); err != nil {
+	subject := data.T("%s Tour %s Bike Tour Confirmation", data.DayMonth(data.TourDetail.Time), data.TourDetail.Code)
+	if err := s.sendEmail(ctx, from, to, bcc, subject, body.String()); err != nil {
 		return fmt.Errorf("send customer email: %v", err)
 	}
 	return nil
 }
 
-func (s *Server) emailBTBA(data *ConfirmationData) error {
-	tmpl, err := texttemplate.ParseFiles(path.Join(s.emailTemplatesDir, "btba.txt"))
+func (s *Server) emailBTBA(ctx context.Context, data *ConfirmationData) error {
+	tmpl, err := s.emailTemplates.Get("btba.txt")
 	if err != nil {
-		return fmt.Errorf("parse BTBA email template: %v", err)
+		return fmt.Errorf("load BTBA email template: %v", err)
 	}
 	var body bytes.Buffer
 	if err := tmpl.Execute(&body, data); err != nil {
@@ -327,13 +449,21 @@ func (s *Server) emailBTBA(data *ConfirmationData) error {
 	if data.Warnings[WarningUnknownHeights] {
 		subject += " | NOHEIGHTS"
 	}
-	if err := s.sendEmail(from, to, nil /*bcc*/, subject, body.String()); err != nil {
+	if len(data.BikeShortages) > 0 {
+		subject += " | BIKES:" + shortageSizes(data.BikeShortages)
+	}
+	if data.TeamAdded {
+		subject += fmt.Sprintf(" | +TEAM(%d)", data.TeamsNeeded)
+	}
+	if err := s.sendEmail(ctx, from, to, nil /*bcc*/, subject, body.String()); err != nil {
 		return fmt.Errorf("send BTBA email: %v", err)
 	}
 	return nil
 }
 
-func (s *Server) sendEmail(from, to, bcc *mail.Email, subject, body string) error {
+func (s *Server) sendEmail(ctx context.Context, from, to, bcc *mail.Email, subject, body string) error {
+	ctx, cancel := context.WithTimeout(ctx, sendgridTimeout)
+	defer cancel()
 	content := mail.NewContent("text/plain", body)
 	m := mail.NewV3MailInit(from, subject, to, content)
 	if bcc != nil {
@@ -342,7 +472,14 @@ func (s *Server) sendEmail(from, to, bcc *mail.Email, subject, body string) erro
 	request := sendgrid.GetRequest(s.sendgridKey, "/v3/mail/send", "https://api.sendgrid.com")
 	request.Method = "POST"
 	request.Body = mail.GetRequestBody(m)
-	_, err := sendgrid.API(request)
+	start := time.Now()
+	response, err := sendgrid.MakeRequestWithContext(ctx, request)
+	if err == nil && response.StatusCode >= 400 {
+		// Not returned as an error, but counted as one.
+		observe("sendgrid", "Send", start, fmt.Errorf("status %d", response.StatusCode))
+	} else {
+		observe("sendgrid", "Send", start, err)
+	}
 	return err
 }
 
@@ -352,22 +489,22 @@ func (s *Server) HandleConfirmation(w http.ResponseWriter, r *http.Request) (cod
 		if e.Error != nil {
 			s.log.Printf("%s: %v", e.Message, e.Error)
 		}
-		tmpl, err := template.ParseFiles(path.Join(s.templatesDir, "confirmation_error.html"))
+		tmpl, err := s.templates.Get("confirmation_error.html")
 		if err != nil {
 			s.log.Printf("%v", err)
 			http.Error(w, e.Message, e.Code)
 			return e.Code, warnings, e.Message
 		}
 		w.WriteHeader(e.Code)
-		if err := tmpl.Execute(w, &ConfirmationErrorData{e.Code, e.Message, s.googleTrackingID}); err != nil {
+		if err := tmpl.Execute(w, &ConfirmationErrorData{Page: s.localizedPage(r), Code: e.Code, Error: e.Message}); err != nil {
 			s.log.Printf("%v", err)
 			http.Error(w, e.Message, e.Code)
 			return e.Code, warnings, e.Message
 		}
 		return e.Code, warnings, e.Message
 	}
-	summary = fmt.Sprintf("tour:%d riders:%d %s %q <%s>", data.TourDetail.ID, data.NumRiders, data.DisplayTotal, data.Name, data.Email)
-	tmpl, err := template.ParseFiles(path.Join(s.templatesDir, "confirmation.html"))
+	summary = fmt.Sprintf("tour:%d order:%d riders:%d %s", data.TourDetail.ID, data.OrderID, data.NumRiders, data.DisplayTotal)
+	tmpl, err := s.templates.Get("confirmation.html")
 	if err != nil {
 		s.log.Printf("%v", err)
 		fmt.Fprint(w, "Reservation accepted") // fallback message
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admin forms that change anything carry a CSRF token too, since
+// browsers send cached basic auth credentials with posts from other
+// sites.
+//
+// Checkout forms carry two protections.  A CSRF token, also set in a
+// cookie by the checkout page, shows the form was posted from that
+// page and not from another site.  A signed checkout payload records
+// the tour and price the customer was shown, so the tour ID and price
+// in the form can't be altered.
+
+const (
+	csrfCookie = "gorez_csrf"
+
+	// A checkout page older than this must be reloaded before paying.
+	checkoutLifetime = 24 * time.Hour
+)
+
+// csrfToken returns the token in the request's CSRF cookie, or a new
+// one if there's none.
+func csrfToken(r *http.Request) (string, error) {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 43 {
+		return c.Value, nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// setCSRFCookie sets the cookie the token in checkout and admin forms
+// must match.  It lasts as long as the browser session.
+func (s *Server) setCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkCSRF reports whether the token posted in a form matches the
+// request's CSRF cookie.
+func checkCSRF(r *http.Request, token string) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(token)) == 1
+}
+
+// adminCSRF returns the CSRF token for an admin page's form, after
+// checking the one posted if this is a POST.
+func adminCSRF(r *http.Request, posted string) (string, *appError) {
+	if r.Method == "POST" && !checkCSRF(r, posted) {
+		return "", &appError{http.StatusForbidden, "This form has expired; please reload the page and try again", fmt.Errorf("CSRF token missing or doesn't match cookie")}
+	}
+	token, err := csrfToken(r)
+	if err != nil {
+		return "", &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("csrfToken: %v", err)}
+	}
+	return token, nil
+}
+
+// CheckoutPayload is what the checkout page showed the customer.
+type CheckoutPayload struct {
+	TourID     int32
+	PriceCents int64
+	Issued     time.Time
+}
+
+// checkoutPayload returns the signed form of p, e.g.
+// "123.4500.1700000000.<signature>".
+func (s *Server) checkoutPayload(p *CheckoutPayload) string {
+	fields := []string{
+		strconv.Itoa(int(p.TourID)),
+		strconv.FormatInt(p.PriceCents, 10),
+		strconv.FormatInt(p.Issued.Unix(), 10),
+	}
+	sig := s.signForm(append([]string{"checkout"}, fields...)...)
+	return strings.Join(append(fields, sig), ".")
+}
+
+// parseCheckoutPayload checks the signature and age of a payload made
+// by checkoutPayload.
+func (s *Server) parseCheckoutPayload(signed string, now time.Time) (*CheckoutPayload, error) {
+	fields := strings.Split(signed, ".")
+	if len(fields) != 4 || !s.verifyForm(fields[3], "checkout", fields[0], fields[1], fields[2]) {
+		return nil, fmt.Errorf("bad checkout payload signature")
+	}
+	tourID, err := strconv.ParseInt(fields[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	priceCents, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	issued, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	p := &CheckoutPayload{TourID: int32(tourID), PriceCents: priceCents, Issued: time.Unix(issued, 0)}
+	if now.Sub(p.Issued) > checkoutLifetime {
+		return nil, fmt.Errorf("checkout payload issued %s has expired", p.Issued.UTC().Format(time.RFC3339))
+	}
+	return p, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckoutPayload(t *testing.T) {
+	s := &Server{formKey: []byte("secret")}
+	issued := time.Unix(1700000000, 0)
+	signed := s.checkoutPayload(&CheckoutPayload{TourID: 123, PriceCents: 4500, Issued: issued})
+	if !strings.HasPrefix(signed, "123.4500.1700000000.") {
+		t.Fatalf("checkoutPayload = %q", signed)
+	}
+
+	p, err := s.parseCheckoutPayload(signed, issued.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("parseCheckoutPayload: %v", err)
+	}
+	if p.TourID != 123 || p.PriceCents != 4500 || !p.Issued.Equal(issued) {
+		t.Errorf("parseCheckoutPayload = %+v", p)
+	}
+
+	sig := signed[strings.LastIndex(signed, ".")+1:]
+	tests := []struct {
+		name   string
+		signed string
+		now    time.Time
+	}{
+		{"expired", signed, issued.Add(checkoutLifetime + time.Second)},
+		{"price changed", "123.100.1700000000." + sig, issued},
+		{"tour changed", "124.4500.1700000000." + sig, issued},
+		{"issued changed", "123.4500.1800000000." + sig, issued},
+		{"no signature", "123.4500.1700000000", issued},
+		{"empty", "", issued},
+		{"other key", (&Server{formKey: []byte("other")}).checkoutPayload(&CheckoutPayload{TourID: 123, PriceCents: 4500, Issued: issued}), issued},
+	}
+	for _, tt := range tests {
+		if p, err := s.parseCheckoutPayload(tt.signed, tt.now); err == nil {
+			t.Errorf("%s: parseCheckoutPayload(%q) = %+v, want error", tt.name, tt.signed, p)
+		}
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	const token = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	tests := []struct {
+		name   string
+		cookie string
+		posted string
+		want   bool
+	}{
+		{"match", token, token, true},
+		{"mismatch", token, strings.Replace(token, "a", "b", 1), false},
+		{"nothing posted", token, "", false},
+		{"no cookie", "", token, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/checkout", nil)
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+		}
+		if got := checkCSRF(r, tt.posted); got != tt.want {
+			t.Errorf("%s: checkCSRF = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAdminCSRF(t *testing.T) {
+	r := httptest.NewRequest("GET", "/admin/teams", nil)
+	token, e := adminCSRF(r, "")
+	if e != nil || len(token) != 43 {
+		t.Fatalf("adminCSRF(GET) = %q, %v; want a new token", token, e)
+	}
+
+	r = httptest.NewRequest("POST", "/admin/teams", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	if got, e := adminCSRF(r, token); e != nil || got != token {
+		t.Errorf("adminCSRF(POST, matching) = %q, %v; want %q", got, e, token)
+	}
+	if _, e := adminCSRF(r, "forged"); e == nil || e.Code != http.StatusForbidden {
+		t.Errorf("adminCSRF(POST, forged) = %v, want 403", e)
+	}
+}
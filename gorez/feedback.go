@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxRating       = 5
+	feedbackDays    = 90 // default period for the admin summary
+	summaryComments = 5  // recent comments shown per guide
+)
+
+// Feedback is a customer's rating of a tour.
+type Feedback struct {
+	OrderID   int32
+	TourID    int32
+	Rating    int // 1..maxRating
+	Comments  string
+	CreatedAt time.Time
+}
+
+// feedbackURL returns the signed link to an order's feedback form, or
+// "" if links can't be signed.
+func (s *Server) feedbackURL(orderID int32) string {
+	token := s.sign("feedback", strconv.Itoa(int(orderID)))
+	if token == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/feedback?OrderNum=%d&Token=%s", s.baseURL, orderID, token)
+}
+
+// FeedbackVars represents the form inputs.
+type FeedbackVars struct {
+	OrderID  int32 `schema:"OrderNum"`
+	Token    string
+	Rating   int
+	Comments string
+}
+
+// RatingOption is one choice on the feedback form.
+type RatingOption struct {
+	Value    int
+	Selected bool
+}
+
+// FeedbackData is the data passed to the feedback template.
+type FeedbackData struct {
+	TourDetail    *TourDetail
+	OrderID       int32
+	Token         string
+	RatingOptions []*RatingOption
+	Comments      string
+	Saved         bool
+	Problem       string
+
+	Page
+}
+
+func (s *Server) feedback(r *http.Request) (*FeedbackData, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if err := r.ParseForm(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars FeedbackVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	if !s.verify(vars.Token, "feedback", strconv.Itoa(int(vars.OrderID))) {
+		return nil, warnings, &appError{http.StatusForbidden, "This feedback link is not valid. Please use the link from your email.", nil}
+	}
+	order, ok, err := s.store.GetOrder(r.Context(), vars.OrderID)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetOrder: %v", err)}
+	}
+	if !ok {
+		return nil, warnings, &appError{http.StatusNotFound, "This feedback link is not valid. Please use the link from your email.", nil}
+	}
+	tourDetail, ok, err := s.store.GetTourDetailByID(r.Context(), order.TourID, maxRiders)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourDetailByID: %v", err)}
+	}
+	if !ok {
+		return nil, warnings, &appError{http.StatusNotFound, fmt.Sprintf("Invalid tour ID %d", order.TourID), nil}
+	}
+
+	data := &FeedbackData{
+		TourDetail: tourDetail,
+		OrderID:    order.ID,
+		Token:      vars.Token,
+		Page:       s.page(r),
+	}
+	if r.Method == "POST" {
+		data.Comments = strings.TrimSpace(vars.Comments)
+		if vars.Rating < 1 || vars.Rating > maxRating {
+			data.Problem = "Please choose a rating."
+		} else {
+			fb := &Feedback{
+				OrderID:   order.ID,
+				TourID:    order.TourID,
+				Rating:    vars.Rating,
+				Comments:  data.Comments,
+				CreatedAt: time.Now(),
+			}
+			if err := s.store.SaveFeedback(r.Context(), fb); err != nil {
+				return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("SaveFeedback: %v", err)}
+			}
+			data.Saved = true
+		}
+	}
+	for v := maxRating; v >= 1; v-- {
+		data.RatingOptions = append(data.RatingOptions, &RatingOption{v, v == vars.Rating})
+	}
+	return data, warnings, nil
+}
+
+func (s *Server) HandleFeedback(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	data, warnings, e := s.feedback(r)
+	if e != nil {
+		if e.Error != nil {
+			s.log.Printf("%s: %v", e.Message, e.Error)
+		}
+		tmpl, err := s.templates.Get("checkout_error.html")
+		if err != nil {
+			s.log.Printf("%v", err)
+			http.Error(w, e.Message, e.Code)
+			return e.Code, warnings, e.Message
+		}
+		w.WriteHeader(e.Code)
+		if err := tmpl.Execute(w, &CheckoutErrorData{Page: s.page(r), Error: e.Message}); err != nil {
+			s.log.Printf("%v", err)
+			http.Error(w, e.Message, e.Code)
+			return e.Code, warnings, e.Message
+		}
+		return e.Code, warnings, e.Message
+	}
+	summary = fmt.Sprintf("order:%d saved:%t", data.OrderID, data.Saved)
+	tmpl, err := s.templates.Get("feedback.html")
+	if err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error parsing feedback template"
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error executing feedback template"
+	}
+	return http.StatusOK, warnings, summary
+}
+
+// GuideFeedback summarizes the feedback on tours a guide or sweep
+// worked.
+type GuideFeedback struct {
+	Guide    string
+	Tours    int
+	Ratings  int
+	Average  float64
+	Comments []*Feedback // most recent first, at most summaryComments
+}
+
+// AdminFeedbackVars represents the form inputs.
+type AdminFeedbackVars struct {
+	Days int
+}
+
+// AdminFeedbackData is the data passed to the admin feedback template.
+type AdminFeedbackData struct {
+	Page
+	Days     int
+	Guides   []*GuideFeedback
+	Warnings map[warning]bool
+}
+
+// summarizeFeedback groups feedback by everyone on each tour's teams.
+func summarizeFeedback(feedback []*Feedback, teams map[int32][]*Team) []*GuideFeedback {
+	byGuide := make(map[string]*GuideFeedback)
+	tours := make(map[string]map[int32]bool)
+	total := make(map[string]int)
+	for _, fb := range feedback { // most recent first
+		seen := make(map[string]bool) // count each person once per tour
+		for _, t := range teams[fb.TourID] {
+			for _, name := range []string{t.Guide, t.Sweep} {
+				if name == "" || seen[name] {
+					continue
+				}
+				seen[name] = true
+				g, ok := byGuide[name]
+				if !ok {
+					g = &GuideFeedback{Guide: name}
+					byGuide[name] = g
+					tours[name] = make(map[int32]bool)
+				}
+				tours[name][fb.TourID] = true
+				g.Ratings++
+				total[name] += fb.Rating
+				if fb.Comments != "" && len(g.Comments) < summaryComments {
+					g.Comments = append(g.Comments, fb)
+				}
+			}
+		}
+	}
+	var result []*GuideFeedback
+	for name, g := range byGuide {
+		g.Tours = len(tours[name])
+		g.Average = float64(total[name]) / float64(g.Ratings)
+		result = append(result, g)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Guide < result[j].Guide })
+	return result
+}
+
+func (s *Server) adminFeedback(r *http.Request) (*AdminFeedbackData, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if !s.isAdmin(r) {
+		return nil, warnings, &appError{http.StatusUnauthorized, "Unauthorized", nil}
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars AdminFeedbackVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	if vars.Days <= 0 {
+		vars.Days = feedbackDays
+	}
+	feedback, err := s.store.GetFeedback(r.Context(), time.Now().AddDate(0, 0, -vars.Days))
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetFeedback: %v", err)}
+	}
+	teams := make(map[int32][]*Team)
+	for _, fb := range feedback {
+		if _, ok := teams[fb.TourID]; ok {
+			continue
+		}
+		t, err := s.store.GetTeams(r.Context(), fb.TourID)
+		if err != nil {
+			s.log.Printf("GetTeams: %v", err)
+			warnings[WarningGetTeams] = true
+		}
+		teams[fb.TourID] = t
+	}
+	return &AdminFeedbackData{Page: staffPage(r), Days: vars.Days, Guides: summarizeFeedback(feedback, teams), Warnings: warnings}, warnings, nil
+}
+
+func (s *Server) HandleAdminFeedback(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	data, warnings, e := s.adminFeedback(r)
+	if e != nil {
+		s.handleAdminError(w, e)
+		return e.Code, warnings, e.Message
+	}
+	summary = fmt.Sprintf("days:%d guides:%d", data.Days, len(data.Guides))
+	tmpl, err := s.templates.Get("admin_feedback.html")
+	if err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error parsing admin feedback template"
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error executing admin feedback template"
+	}
+	return http.StatusOK, warnings, summary
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Card testers post stolen card numbers to /thankyou to find the ones
+// that work.  CheckoutGuard limits how often one IP address or email
+// address can try to check out, blocks them for a while after repeated
+// declines, and can make clients that look suspicious pass a
+// Challenge first.  Its state is per instance, so with several
+// instances the limits are per instance too.
+
+// rateLimit allows Count events within Window.
+type rateLimit struct {
+	Count  int
+	Window time.Duration
+}
+
+// parseRateLimit parses a limit like "10/1h".
+func parseRateLimit(s string) (rateLimit, error) {
+	count, window, ok := strings.Cut(strings.TrimSpace(s), "/")
+	var l rateLimit
+	var err error
+	if l.Count, err = strconv.Atoi(count); !ok || err != nil || l.Count <= 0 {
+		return l, fmt.Errorf("invalid limit %q: want count/duration", s)
+	}
+	if l.Window, err = time.ParseDuration(window); err != nil || l.Window <= 0 {
+		return l, fmt.Errorf("invalid limit %q: want count/duration", s)
+	}
+	return l, nil
+}
+
+// eventLog records recent events by key, e.g. checkouts by IP.
+type eventLog struct {
+	window time.Duration
+	times  map[string][]time.Time
+}
+
+func newEventLog(window time.Duration) *eventLog {
+	return &eventLog{window, make(map[string][]time.Time)}
+}
+
+// add records an event and returns how many there have been within the
+// window, including it.
+func (l *eventLog) add(key string, now time.Time) int {
+	times := append(dropBefore(l.times[key], now.Add(-l.window)), now)
+	l.times[key] = times
+	return len(times)
+}
+
+// count returns how many events there have been within the window.
+func (l *eventLog) count(key string, now time.Time) int {
+	return len(dropBefore(l.times[key], now.Add(-l.window)))
+}
+
+// sweep forgets keys with no events within the window.
+func (l *eventLog) sweep(now time.Time) {
+	for key, times := range l.times {
+		if len(dropBefore(times, now.Add(-l.window))) == 0 {
+			delete(l.times, key)
+		}
+	}
+}
+
+// Challenge is an extra check, such as a CAPTCHA or a proof of work,
+// that clients must pass to check out after suspicious activity.
+type Challenge interface {
+	// New returns the puzzle to put in the checkout form.
+	New(now time.Time) (string, error)
+	// Verify checks the answer the checkout form posted as Proof.
+	Verify(ctx context.Context, answer string, now time.Time) (bool, error)
+}
+
+// CheckoutGuard decides whether a checkout may go ahead.
+type CheckoutGuard struct {
+	ipLimit      rateLimit
+	emailLimit   rateLimit
+	declineLimit rateLimit
+	block        time.Duration
+	challenge    Challenge // nil if challenges are disabled
+
+	mu            sync.Mutex
+	byIP, byEmail *eventLog // checkout attempts
+	declines      *eventLog // by IP and email key
+	blockedUntil  map[string]time.Time
+	lastSweep     time.Time
+}
+
+func NewCheckoutGuard(ipLimit, emailLimit, declineLimit rateLimit, block time.Duration, challenge Challenge) *CheckoutGuard {
+	return &CheckoutGuard{
+		ipLimit:      ipLimit,
+		emailLimit:   emailLimit,
+		declineLimit: declineLimit,
+		block:        block,
+		challenge:    challenge,
+		byIP:         newEventLog(ipLimit.Window),
+		byEmail:      newEventLog(emailLimit.Window),
+		declines:     newEventLog(declineLimit.Window),
+		blockedUntil: make(map[string]time.Time),
+	}
+}
+
+// guardKeys returns the keys for an IP address and an email address.
+// The email key is empty if there's no address.
+func guardKeys(ip, email string) (ipKey, emailKey string) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email != "" {
+		emailKey = "email:" + email
+	}
+	return "ip:" + ip, emailKey
+}
+
+// Attempt records a checkout attempt and returns a warning if it must
+// be refused: WarningCheckoutBlocked if the IP or email address is
+// blocked after repeated declines, or WarningRateLimited if it has
+// tried too often.
+func (g *CheckoutGuard) Attempt(ip, email string, now time.Time) warning {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maybeSweep(now)
+	ipKey, emailKey := guardKeys(ip, email)
+	if now.Before(g.blockedUntil[ipKey]) || (emailKey != "" && now.Before(g.blockedUntil[emailKey])) {
+		return WarningCheckoutBlocked
+	}
+	limited := g.byIP.add(ipKey, now) > g.ipLimit.Count
+	if emailKey != "" && g.byEmail.add(emailKey, now) > g.emailLimit.Count {
+		limited = true
+	}
+	if limited {
+		return WarningRateLimited
+	}
+	return ""
+}
+
+// Declined records a declined card and reports whether it got the IP
+// or email address blocked.
+func (g *CheckoutGuard) Declined(ip, email string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ipKey, emailKey := guardKeys(ip, email)
+	blocked := false
+	for _, key := range []string{ipKey, emailKey} {
+		if key == "" {
+			continue
+		}
+		if g.declines.add(key, now) >= g.declineLimit.Count {
+			g.blockedUntil[key] = now.Add(g.block)
+			blocked = true
+		}
+	}
+	return blocked
+}
+
+// NeedsChallenge reports whether a client must pass the challenge
+// before checking out: if its IP address has had a card declined
+// recently or has used half its attempts.
+func (g *CheckoutGuard) NeedsChallenge(ip string, now time.Time) bool {
+	if g.challenge == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ipKey, _ := guardKeys(ip, "")
+	return g.declines.count(ipKey, now) > 0 || 2*g.byIP.count(ipKey, now) >= g.ipLimit.Count
+}
+
+// Puzzle returns a challenge puzzle for the checkout page if the
+// client must pass the challenge, or "" if not.
+func (g *CheckoutGuard) Puzzle(ip string, now time.Time) (string, error) {
+	if !g.NeedsChallenge(ip, now) {
+		return "", nil
+	}
+	return g.challenge.New(now)
+}
+
+// CheckChallenge reports whether a client that must pass the
+// challenge has done so.  Clients that needn't always pass.
+func (g *CheckoutGuard) CheckChallenge(ctx context.Context, ip, answer string, now time.Time) (bool, error) {
+	if !g.NeedsChallenge(ip, now) {
+		return true, nil
+	}
+	return g.challenge.Verify(ctx, answer, now)
+}
+
+// maybeSweep forgets old state once a minute.
+func (g *CheckoutGuard) maybeSweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	g.byIP.sweep(now)
+	g.byEmail.sweep(now)
+	g.declines.sweep(now)
+	for key, until := range g.blockedUntil {
+		if !now.Before(until) {
+			delete(g.blockedUntil, key)
+		}
+	}
+}
+
+// ProofOfWork is a Challenge that makes the browser find a number
+// which, appended to a signed puzzle, gives a SHA-256 hash starting
+// with bits zero bits.  Each extra bit doubles the work; at 18 bits a
+// phone takes a second or two.  Each answer is accepted once.
+type ProofOfWork struct {
+	key  []byte
+	bits int
+
+	mu   sync.Mutex
+	used map[string]time.Time // puzzle nonce -> when it expires
+}
+
+// proofLifetime is how long a puzzle can be answered.
+const proofLifetime = 30 * time.Minute
+
+func NewProofOfWork(key []byte, bits int) *ProofOfWork {
+	return &ProofOfWork{key: key, bits: bits, used: make(map[string]time.Time)}
+}
+
+// New returns a puzzle like "<nonce>.<issued>.<bits>.<signature>".
+func (p *ProofOfWork) New(now time.Time) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	fields := []string{base64.RawURLEncoding.EncodeToString(b), strconv.FormatInt(now.Unix(), 10), strconv.Itoa(p.bits)}
+	sig := hmacSign(p.key, append([]string{"proof"}, fields...)...)
+	return strings.Join(append(fields, sig), "."), nil
+}
+
+// Verify checks an answer of the form "<puzzle>~<number>".
+func (p *ProofOfWork) Verify(ctx context.Context, answer string, now time.Time) (bool, error) {
+	puzzle, _, ok := strings.Cut(answer, "~")
+	fields := strings.Split(puzzle, ".")
+	if !ok || len(fields) != 4 || !hmacVerify(p.key, fields[3], "proof", fields[0], fields[1], fields[2]) {
+		return false, nil
+	}
+	issued, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || now.Sub(time.Unix(issued, 0)) > proofLifetime {
+		return false, nil
+	}
+	bits, err := strconv.Atoi(fields[2])
+	if err != nil || bits < p.bits || !leadingZeroBits(sha256.Sum256([]byte(answer)), bits) {
+		return false, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for nonce, expires := range p.used {
+		if now.After(expires) {
+			delete(p.used, nonce)
+		}
+	}
+	if _, ok := p.used[fields[0]]; ok {
+		return false, nil
+	}
+	p.used[fields[0]] = time.Unix(issued, 0).Add(proofLifetime)
+	return true, nil
+}
+
+func leadingZeroBits(sum [sha256.Size]byte, bits int) bool {
+	for i := 0; i < bits; i++ {
+		if sum[i/8]&(0x80>>(i%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and
+// CIDR ranges.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			if ip := net.ParseIP(f); ip != nil && ip.To4() != nil {
+				f += "/32"
+			} else {
+				f += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", f)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientIP returns the address of the client, which is the last one a
+// trusted proxy added to X-Forwarded-For if the request came through
+// one.
+func (s *Server) clientIP(r *http.Request) string {
+	ip := remoteHost(r)
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0 && s.trustedProxy(ip); i-- {
+		next := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(next) == nil {
+			break
+		}
+		ip = next
+	}
+	return ip
+}
+
+func (s *Server) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, n := range s.trustedProxies {
+		if parsed != nil && n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    rateLimit
+		wantErr bool
+	}{
+		{"10/1h", rateLimit{10, time.Hour}, false},
+		{" 3/15m ", rateLimit{3, 15 * time.Minute}, false},
+		{"10", rateLimit{}, true},
+		{"0/1h", rateLimit{}, true},
+		{"ten/1h", rateLimit{}, true},
+		{"10/0s", rateLimit{}, true},
+		{"10/hour", rateLimit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRateLimit(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseRateLimit(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+// solve finds an answer to a ProofOfWork puzzle with the given bits.
+func solve(t *testing.T, puzzle string, bits int) string {
+	t.Helper()
+	for i := 0; i < 1<<24; i++ {
+		answer := puzzle + "~" + strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(answer)), bits) {
+			return answer
+		}
+	}
+	t.Fatalf("no answer found for %q", puzzle)
+	return ""
+}
+
+func TestProofOfWork(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	p := NewProofOfWork([]byte("secret"), 8)
+	puzzle, err := p.New(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := solve(t, puzzle, 8)
+
+	if ok, err := p.Verify(ctx, answer, now.Add(proofLifetime+time.Second)); ok || err != nil {
+		t.Errorf("Verify(expired) = %v, %v; want false", ok, err)
+	}
+	if ok, err := p.Verify(ctx, answer, now.Add(time.Minute)); !ok || err != nil {
+		t.Errorf("Verify = %v, %v; want true", ok, err)
+	}
+	if ok, _ := p.Verify(ctx, answer, now.Add(2*time.Minute)); ok {
+		t.Error("Verify(replayed) = true, want false")
+	}
+
+	// A puzzle signed for fewer bits than the server wants is refused,
+	// as is one whose bits were lowered after signing.
+	easy := NewProofOfWork([]byte("secret"), 1)
+	easyPuzzle, err := easy.New(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := p.Verify(ctx, solve(t, easyPuzzle, 1), now); ok {
+		t.Error("Verify(puzzle for 1 bit) = true, want false")
+	}
+	puzzle, err = p.New(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Split(puzzle, ".")
+	fields[2] = "1"
+	if ok, _ := p.Verify(ctx, solve(t, strings.Join(fields, "."), 1), now); ok {
+		t.Error("Verify(bits lowered) = true, want false")
+	}
+
+	// Wrong answers, and answers signed with another key, are refused.
+	puzzle, err = p.New(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		wrong := puzzle + "~" + strconv.Itoa(i)
+		if !leadingZeroBits(sha256.Sum256([]byte(wrong)), 8) {
+			if ok, _ := p.Verify(ctx, wrong, now); ok {
+				t.Errorf("Verify(%q) = true, want false", wrong)
+			}
+			break
+		}
+	}
+	other := NewProofOfWork([]byte("other"), 8)
+	otherPuzzle, err := other.New(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := p.Verify(ctx, solve(t, otherPuzzle, 8), now); ok {
+		t.Error("Verify(other key) = true, want false")
+	}
+	for _, garbage := range []string{"", "~1", puzzle, "a.b.c.d~1"} {
+		if ok, _ := p.Verify(ctx, garbage, now); ok {
+			t.Errorf("Verify(%q) = true, want false", garbage)
+		}
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	var sum [sha256.Size]byte
+	sum[1] = 0x10 // 11 leading zero bits
+	for bits, want := range map[int]bool{0: true, 8: true, 11: true, 12: false, 16: false} {
+		if got := leadingZeroBits(sum, bits); got != want {
+			t.Errorf("leadingZeroBits(%d) = %v, want %v", bits, got, want)
+		}
+	}
+}
+
+func TestCheckoutGuardRateLimit(t *testing.T) {
+	g := NewCheckoutGuard(rateLimit{3, time.Hour}, rateLimit{2, time.Hour}, rateLimit{3, time.Hour}, time.Hour, nil)
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if w := g.Attempt("10.0.0.1", "", now); w != "" {
+			t.Fatalf("attempt %d = %q, want allowed", i+1, w)
+		}
+	}
+	if w := g.Attempt("10.0.0.1", "", now); w != WarningRateLimited {
+		t.Errorf("attempt over the IP limit = %q, want %q", w, WarningRateLimited)
+	}
+	if w := g.Attempt("10.0.0.1", "", now.Add(time.Hour+time.Second)); w != "" {
+		t.Errorf("attempt after the window = %q, want allowed", w)
+	}
+
+	// The email limit applies across IP addresses, ignoring case.
+	g.Attempt("10.0.0.2", "jane@example.com", now)
+	g.Attempt("10.0.0.3", "Jane@Example.com ", now)
+	if w := g.Attempt("10.0.0.4", "jane@example.com", now); w != WarningRateLimited {
+		t.Errorf("attempt over the email limit = %q, want %q", w, WarningRateLimited)
+	}
+}
+
+func TestCheckoutGuardDeclines(t *testing.T) {
+	g := NewCheckoutGuard(rateLimit{100, time.Hour}, rateLimit{100, time.Hour}, rateLimit{3, time.Hour}, 2*time.Hour, nil)
+	now := time.Unix(1700000000, 0)
+
+	if g.Declined("10.0.0.1", "a@example.com", now) || g.Declined("10.0.0.1", "b@example.com", now) {
+		t.Fatal("blocked before the decline limit")
+	}
+	if !g.Declined("10.0.0.1", "c@example.com", now) {
+		t.Fatal("third decline from one IP didn't block it")
+	}
+	if w := g.Attempt("10.0.0.1", "d@example.com", now.Add(time.Minute)); w != WarningCheckoutBlocked {
+		t.Errorf("attempt from blocked IP = %q, want %q", w, WarningCheckoutBlocked)
+	}
+	if w := g.Attempt("10.0.0.2", "a@example.com", now.Add(time.Minute)); w != "" {
+		t.Errorf("attempt from another IP and email = %q, want allowed", w)
+	}
+	if w := g.Attempt("10.0.0.1", "d@example.com", now.Add(2*time.Hour)); w != "" {
+		t.Errorf("attempt after the block = %q, want allowed", w)
+	}
+}
+
+type fakeChallenge struct{ verified bool }
+
+func (c *fakeChallenge) New(now time.Time) (string, error) { return "puzzle", nil }
+
+func (c *fakeChallenge) Verify(ctx context.Context, answer string, now time.Time) (bool, error) {
+	c.verified = true
+	return answer == "right", nil
+}
+
+func TestCheckoutGuardChallenge(t *testing.T) {
+	challenge := &fakeChallenge{}
+	g := NewCheckoutGuard(rateLimit{4, time.Hour}, rateLimit{100, time.Hour}, rateLimit{3, time.Hour}, time.Hour, challenge)
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+
+	if puzzle, _ := g.Puzzle("10.0.0.1", now); puzzle != "" {
+		t.Errorf("Puzzle for a new client = %q, want none", puzzle)
+	}
+	if ok, _ := g.CheckChallenge(ctx, "10.0.0.1", "", now); !ok || challenge.verified {
+		t.Error("CheckChallenge for a new client wasn't waved through")
+	}
+
+	// Half the IP limit, or any decline, brings on the challenge.
+	g.Attempt("10.0.0.1", "", now)
+	g.Attempt("10.0.0.1", "", now)
+	g.Declined("10.0.0.2", "", now)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if puzzle, _ := g.Puzzle(ip, now); puzzle != "puzzle" {
+			t.Errorf("Puzzle(%s) = %q, want a puzzle", ip, puzzle)
+		}
+		if ok, _ := g.CheckChallenge(ctx, ip, "wrong", now); ok {
+			t.Errorf("CheckChallenge(%s, wrong) = true, want false", ip)
+		}
+		if ok, _ := g.CheckChallenge(ctx, ip, "right", now); !ok {
+			t.Errorf("CheckChallenge(%s, right) = false, want true", ip)
+		}
+	}
+
+	if NewCheckoutGuard(rateLimit{4, time.Hour}, rateLimit{4, time.Hour}, rateLimit{1, time.Hour}, time.Hour, nil).NeedsChallenge("10.0.0.1", now) {
+		t.Error("NeedsChallenge without a challenge = true, want false")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: proxies}
+	tests := []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"}, // not a proxy
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		{"192.168.1.1:1234", "spoofed, 198.51.100.1, 10.9.9.9", "198.51.100.1"},
+		{"10.1.2.3:1234", "1.2.3.4, garbage", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/thankyou", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := s.clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%s, %q) = %q, want %q", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parseTrustedProxies(10.0.0.0/33) succeeded, want error")
+	}
+}
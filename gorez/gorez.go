@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
-	"html/template"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/schema"
@@ -23,17 +28,58 @@ var (
 	sendgridKey           = flag.String("sendgrid_key", "", "SendGrid API key")
 	stripeSecretKey       = flag.String("stripe_secret_key", "", "Stripe key used by server")
 	stripePublishableKey  = flag.String("stripe_publishable_key", "", "Stripe key to embed in Javascript")
-	templatesDir          = flag.String("templates_dir", "templates", "directory containing templates")
+	templatesDir          = flag.String("templates_dir", "", "directory containing templates (empty means those built into the binary)")
 	emailTemplatesDir     = flag.String("email_templates_dir", "", "directory containing email templates")
 	requestLog            = flag.String("request_log", "", "file for request logs (empty means stdout)")
 	debugLog              = flag.String("debug_log", "", "file for debug logs (empty means stdout)")
 	googleTrackingID      = flag.String("google_tracking_id", "", "Google Analytics tracking ID")
 	googleConversionID    = flag.Int("google_conversion_id", 0, "Google AdWords conversion ID")
 	googleConversionLabel = flag.String("google_conversion_label", "", "Google AdWords conversion label")
+	adminPassword         = flag.String("admin_password", "", "password for admin pages (empty disables them)")
+	signingKey            = flag.String("signing_key", "", "secret for signing links sent to customers and guides, and checkout forms (required except with -dev)")
+	baseURL               = flag.String("base_url", "", "public URL of this server, for links in emails")
+	smsAPIURL             = flag.String("sms_api_url", "", "URL of the SMS provider's send-message endpoint (empty disables texts)")
+	smsUser               = flag.String("sms_user", "", "user name (e.g. account SID) for the SMS provider")
+	smsPassword           = flag.String("sms_password", "", "password (e.g. auth token) for the SMS provider")
+	smsFrom               = flag.String("sms_from", "", "E.164 number texts are sent from")
+	schedulerInterval     = flag.Duration("scheduler_interval", 5*time.Minute, "how often to look for reminders and follow-ups to send")
+	reminderLead          = flag.Duration("reminder_lead", 24*time.Hour, "how long before a tour to email a reminder (0 disables reminders)")
+	followupDelay         = flag.Duration("followup_delay", 2*time.Hour, "how long after a tour ends to email a follow-up (0 disables follow-ups)")
+	devMode               = flag.Bool("dev", false, "re-read templates when they change on disk; page templates come from ./templates unless -templates_dir is set")
+	ridersPerTeam         = flag.String("riders_per_team", "10", "riders one team can lead, e.g. \"10,CPN=8\" (bare number is the default)")
+	reconcileInterval     = flag.Duration("reconcile_interval", time.Hour, "how often to reconcile charges against orders (0 disables)")
+	reconcileLookback     = flag.Duration("reconcile_lookback", 72*time.Hour, "how far back to look for charges when reconciling")
+	alertRules            = flag.String("alert_rules", "input_bad/tour_oversubscribed,db_failure/payment_recorded,email_failure/customer,db_failure/*=5/10m,http/5xx=5/5m,fraud/blocked", "warnings that alert the operators, e.g. \"db_failure/*=5/10m\" (5 within 10 minutes; bare warning means the first one)")
+	alertEmail            = flag.String("alert_email", "", "comma-separated addresses to email alerts to")
+	alertWebhook          = flag.String("alert_webhook", "", "URL to post alerts to as JSON")
+	alertCooldown         = flag.Duration("alert_cooldown", 30*time.Minute, "how long a rule stays quiet after alerting")
+	alertMaxPerHour       = flag.Int("alert_max_per_hour", 10, "most alerts sent in any hour")
+	shutdownDelay         = flag.Duration("shutdown_delay", 0, "how long to fail readiness checks before closing the listener on SIGTERM")
+	shutdownTimeout       = flag.Duration("shutdown_timeout", time.Minute, "how long to wait for requests and background work to finish on SIGTERM")
+	tourTimeZone          = flag.String("tour_time_zone", defaultTimeZone, "IANA time zone of tours with no Master.TimeZone")
+	checkoutIPLimit       = flag.String("checkout_ip_limit", "10/1h", "checkouts allowed from one IP address, e.g. \"10/1h\" (10 per hour)")
+	checkoutEmailLimit    = flag.String("checkout_email_limit", "5/1h", "checkouts allowed for one email address")
+	declineLimit          = flag.String("decline_limit", "3/1h", "card declines for one IP or email address that block it")
+	declineBlock          = flag.Duration("decline_block", 6*time.Hour, "how long an IP or email address stays blocked after too many declines")
+	challengeBits         = flag.Int("challenge_bits", 0, "proof-of-work difficulty for suspicious clients, in bits (0 disables the challenge)")
+	trustedProxies        = flag.String("trusted_proxies", "", "comma-separated IP addresses or CIDR ranges of proxies whose X-Forwarded-For is trusted")
+	cspReportOnly         = flag.Bool("csp_report_only", false, "send the Content Security Policy as report-only, for trying out changes to it")
 )
 
 const (
 	maxRiders = 14
+	guideDays = 14 // how far ahead guide pages look
+
+	// Checkouts wait on Stripe and SendGrid, so writes get longer.
+	readTimeout  = 30 * time.Second
+	writeTimeout = 2 * time.Minute
+	idleTimeout  = 2 * time.Minute
+
+	// Each call to a dependency gives up after this long.
+	dbTimeout       = 10 * time.Second
+	stripeTimeout   = 30 * time.Second
+	sendgridTimeout = 15 * time.Second
+	smsTimeout      = 10 * time.Second
 )
 
 type warning string
@@ -48,11 +94,24 @@ const (
 	WarningUnknownHeights     = warning("input_bad/unknown_heights") // common
 	WarningNoName             = warning("input_bad/no_name")
 	WarningNoEmail            = warning("input_bad/no_email")
+	WarningInvalidMobile      = warning("input_bad/invalid_mobile")
+	WarningCSRF               = warning("input_bad/csrf")
+	WarningFormTampered       = warning("input_bad/form_tampered")
 	WarningPaymentRecorded    = warning("db_failure/payment_recorded")
 	WarningConfirmationSent   = warning("db_failure/confirmation_sent")
 	WarningGetTeams           = warning("db_failure/get_teams")
+	WarningGetRoster          = warning("db_failure/get_roster")
+	WarningGetGuideEmails     = warning("db_failure/get_guide_emails")
+	WarningGetPendingRiders   = warning("db_failure/get_pending_riders")
+	WarningGetBikes           = warning("db_failure/get_bikes")
+	WarningBikesShort         = warning("inventory/bikes_short")
 	WarningEmailCustomer      = warning("email_failure/customer")
 	WarningEmailBTBA          = warning("email_failure/btba")
+	WarningEmailGuide         = warning("email_failure/guide")
+	WarningSMSCustomer        = warning("sms_failure/customer")
+	WarningRateLimited        = warning("fraud/rate_limited")
+	WarningCheckoutBlocked    = warning("fraud/blocked")
+	WarningChallengeFailed    = warning("fraud/challenge_failed")
 )
 
 func warningsList(warnings map[warning]bool) []string {
@@ -67,19 +126,63 @@ func warningsList(warnings map[warning]bool) []string {
 type Server struct {
 	store                 Store
 	sendgridKey           string
-	stripeSecretKey       string
 	stripePublishableKey  string
-	templatesDir          string
-	emailTemplatesDir     string
+	templates             *Templates
+	emailTemplates        *Templates
+	emailTemplatesDir     string // for weather_advisory.txt
 	googleTrackingID      string
 	googleConversionID    int
 	googleConversionLabel string
+	adminPassword         string
+	teamRatios            *teamRatios
+	signingKey            []byte
+	formKey               []byte // for signForm
+	guard                 *CheckoutGuard
+	trustedProxies        []*net.IPNet
+	baseURL               string
+	timeZone              *time.Location // default tour zone, for "today" on staff pages
+	payments              Payments
+	sms                   SMSSender   // nil if texts are disabled
+	draining              atomic.Bool // set on SIGTERM to fail readiness checks
 	decoder               *schema.Decoder
 	log                   *log.Logger
 }
 
-func NewServer(dsn, sendgridKey, stripeSecretKey, stripePublishableKey, templatesDir, emailTemplatesDir, googleTrackingID string, googleConversionID int, googleConversionLabel string, log *log.Logger) (*Server, error) {
-	db, err := sql.Open("mysql", dsn)
+// NewServer connects to the database and loads the templates.  The
+// config should have been validated.
+func NewServer(cfg *Config, log *log.Logger) (*Server, error) {
+	teamRatios, err := parseTeamRatios(cfg.RidersPerTeam)
+	if err != nil {
+		return nil, err
+	}
+	timeZone, err := time.LoadLocation(cfg.TourTimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("tour time zone: %v", err)
+	}
+	trustedProxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	var limits [3]rateLimit
+	for i, l := range []string{cfg.CheckoutIPLimit, cfg.CheckoutEmailLimit, cfg.DeclineLimit} {
+		if limits[i], err = parseRateLimit(l); err != nil {
+			return nil, err
+		}
+	}
+	if err := loadCatalogs(); err != nil {
+		return nil, err
+	}
+	templates, err := loadPageTemplates(cfg.TemplatesDir, cfg.Dev)
+	if err != nil {
+		return nil, fmt.Errorf("page templates: %v", err)
+	}
+	emailTemplates, err := loadEmailTemplates(cfg.EmailTemplatesDir, cfg.Dev)
+	if err != nil {
+		return nil, fmt.Errorf("email templates: %v", err)
+	}
+	// Times are exchanged with the database as UTC clock readings
+	// (see tourTime), so Validate rejects a DSN with any other loc.
+	db, err := sql.Open("mysql", cfg.BookingsDSN)
 	if err != nil {
 		return nil, err
 	}
@@ -95,36 +198,85 @@ func NewServer(dsn, sendgridKey, stripeSecretKey, stripePublishableKey, template
 	if err := db.Ping(); err != nil {
 		return nil, err
 	}
-	return &Server{
-		store:                 &RemoteStore{db},
-		sendgridKey:           sendgridKey,
-		stripeSecretKey:       stripeSecretKey,
-		stripePublishableKey:  stripePublishableKey,
-		templatesDir:          templatesDir,
-		emailTemplatesDir:     emailTemplatesDir,
-		googleTrackingID:      googleTrackingID,
-		googleConversionID:    googleConversionID,
-		googleConversionLabel: googleConversionLabel,
+	formKey := []byte(cfg.SigningKey)
+	if len(formKey) == 0 {
+		// Only in dev mode; Validate requires a key otherwise.
+		log.Printf("No signing key; checkout pages served before a restart will be rejected")
+		if formKey, err = newFormKey(); err != nil {
+			return nil, err
+		}
+	}
+	var challenge Challenge
+	if cfg.ChallengeBits > 0 {
+		challenge = NewProofOfWork(formKey, cfg.ChallengeBits)
+	}
+	s := &Server{
+		store:                 &metricsStore{&RemoteStore{db, newZoneCache(timeZone)}},
+		sendgridKey:           cfg.SendgridKey,
+		payments:              &metricsPayments{NewStripePayments(cfg.StripeSecretKey)},
+		stripePublishableKey:  cfg.StripePublishableKey,
+		templates:             templates,
+		emailTemplates:        emailTemplates,
+		emailTemplatesDir:     cfg.EmailTemplatesDir,
+		googleTrackingID:      cfg.GoogleTrackingID,
+		googleConversionID:    cfg.GoogleConversionID,
+		googleConversionLabel: cfg.GoogleConversionLabel,
+		adminPassword:         cfg.AdminPassword,
+		teamRatios:            teamRatios,
+		signingKey:            []byte(cfg.SigningKey),
+		formKey:               formKey,
+		guard:                 NewCheckoutGuard(limits[0], limits[1], limits[2], cfg.DeclineBlock, challenge),
+		trustedProxies:        trustedProxies,
+		baseURL:               strings.TrimSuffix(cfg.BaseURL, "/"),
+		timeZone:              timeZone,
 		decoder:               schema.NewDecoder(),
 		log:                   log,
-	}, nil
+	}
+	if cfg.SMSAPIURL != "" {
+		s.sms = NewHTTPSMSSender(cfg.SMSAPIURL, cfg.SMSUser, cfg.SMSPassword, cfg.SMSFrom)
+	}
+	return s, nil
+}
+
+// Page holds the data layout.html needs on every page.  Each page's
+// data embeds it.
+type Page struct {
+	GoogleTrackingID string // empty on staff pages, which aren't tracked
+	Lang             string // empty on staff pages, which are in English
+	Nonce            string // for inline scripts; see security.go
+}
+
+// page returns the Page for customer-facing pages.
+func (s *Server) page(r *http.Request) Page {
+	return Page{GoogleTrackingID: s.googleTrackingID, Lang: defaultLanguage, Nonce: cspNonce(r)}
+}
+
+// localizedPage returns the Page for customer-facing pages that have
+// been translated, in the language the customer asked for.
+func (s *Server) localizedPage(r *http.Request) Page {
+	return Page{GoogleTrackingID: s.googleTrackingID, Lang: language(r), Nonce: cspNonce(r)}
+}
+
+// staffPage returns the Page for staff pages.
+func staffPage(r *http.Request) Page {
+	return Page{Nonce: cspNonce(r)}
 }
 
 type NotFoundData struct {
-	GoogleTrackingID string
+	Page
 }
 
 func (s *Server) HandleDefault(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
 	warnings = make(map[warning]bool)
 	summary = "page not found"
-	tmpl, err := template.ParseFiles(path.Join(s.templatesDir, "notfound.html"))
+	tmpl, err := s.templates.Get("notfound.html")
 	if err != nil {
 		s.log.Printf("%v", err)
 		http.NotFound(w, r)
 		return http.StatusNotFound, warnings, summary
 	}
 	w.WriteHeader(http.StatusNotFound)
-	if err := tmpl.Execute(w, &NotFoundData{s.googleTrackingID}); err != nil {
+	if err := tmpl.Execute(w, &NotFoundData{s.page(r)}); err != nil {
 		s.log.Printf("%v", err)
 		http.NotFound(w, r)
 		return http.StatusNotFound, warnings, summary
@@ -140,52 +292,194 @@ type appError struct {
 	Error   error  // for server debug logs
 }
 
+// handlerFunc handles a request and reports what happened for the
+// request log.
+type handlerFunc func(http.ResponseWriter, *http.Request) (code int, warnings map[warning]bool, summary string)
+
+// logHandler writes one request log entry per request, updates the
+// request metrics and checks the warnings against the alert rules.
+// Route is the pattern the handler is registered under.
 type logHandler struct {
-	log    *log.Logger
-	handle func(http.ResponseWriter, *http.Request) (code int, warnings map[warning]bool, summary string)
+	log      *slog.Logger
+	route    string
+	handle   handlerFunc
+	alerts   *Alerter // nil if alerts are disabled
+	clientIP func(r *http.Request) string
 }
 
 func (h *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := requestID(r)
+	w.Header().Set("X-Request-Id", id)
 	code, warnings, summary := h.handle(w, r)
+	recordRequest(h.route, code, time.Since(start), warnings)
+	h.alerts.Observe(h.route, code, warnings, summary)
+	attrs := []slog.Attr{
+		slog.String("request_id", id),
+		slog.String("remote", h.clientIP(r)),
+		slog.String("method", r.Method),
+		slog.String("route", h.route),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", code),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.Any("warnings", warningsList(warnings)),
+		slog.Any("form", loggedForm(r.Form)),
+		slog.String("summary", summary),
+	}
+	tourID, orderID := summaryIDs(summary)
+	if tourID != 0 {
+		attrs = append(attrs, slog.Int64("tour_id", tourID))
+	}
+	if orderID != 0 {
+		attrs = append(attrs, slog.Int64("order_id", orderID))
+	}
+	h.log.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+}
+
+// remoteHost returns the IP address the request came from, which is a
+// proxy's if there is one; see clientIP.
+func remoteHost(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		host = r.RemoteAddr
+		return r.RemoteAddr
 	}
-	h.log.Printf("%s %s %s %s code:%d warnings:%v %s\n", host, r.Method, r.URL.Path, r.Form.Encode(), code, warningsList(warnings), summary)
+	return host
 }
 
 func main() {
 	flag.Parse()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	requestLogWriter := os.Stdout
-	if *requestLog != "" {
-		var err error
-		requestLogWriter, err = os.OpenFile(*requestLog, os.O_APPEND|os.O_CREATE, 0644)
+	if cfg.RequestLog != "" {
+		requestLogWriter, err = os.OpenFile(cfg.RequestLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
-	requestLog := log.New(requestLogWriter, "", log.LstdFlags)
+	requestLog := newLogger(requestLogWriter, false)
 
 	debugLogWriter := os.Stdout
-	if *debugLog != "" {
-		var err error
-		debugLogWriter, err = os.OpenFile(*debugLog, os.O_APPEND|os.O_CREATE, 0644)
+	if cfg.DebugLog != "" {
+		debugLogWriter, err = os.OpenFile(cfg.DebugLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
-	debugLog := log.New(debugLogWriter, "", log.LstdFlags|log.Lshortfile)
+	// The rest of the server logs through a *log.Logger, so the debug
+	// log wraps a JSON logger; each Printf becomes one entry.
+	debugLog := slog.NewLogLogger(newLogger(debugLogWriter, true).Handler(), slog.LevelInfo)
 
-	server, err := NewServer(*bookingsDSN, *sendgridKey, *stripeSecretKey, *stripePublishableKey, *templatesDir, *emailTemplatesDir, *googleTrackingID, *googleConversionID, *googleConversionLabel, debugLog)
+	server, err := NewServer(cfg, debugLog)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// "gorez [flags] reconcile [-since 72h] [-dry_run]" reconciles
+	// once and exits instead of serving.
+	if flag.Arg(0) == "reconcile" {
+		os.Exit(runReconcile(server, cfg, flag.Args()[1:]))
+	}
+	// "gorez [flags] guide_link NAME..." prints each guide's link to
+	// their tours, for the office to send them.
+	if flag.Arg(0) == "guide_link" {
+		os.Exit(runGuideLink(server, flag.Args()[1:]))
+	}
+
+	rules, err := parseAlertRules(cfg.AlertRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var alertSinks []AlertSink
+	if cfg.AlertEmail != "" {
+		alertSinks = append(alertSinks, NewEmailAlertSink(server, strings.Split(cfg.AlertEmail, ",")))
+	}
+	if cfg.AlertWebhook != "" {
+		alertSinks = append(alertSinks, NewWebhookAlertSink(cfg.AlertWebhook))
+	}
+	var alerter *Alerter
+	if len(alertSinks) > 0 {
+		alerter = NewAlerter(rules, alertSinks, cfg.AlertCooldown, cfg.AlertMaxPerHour, debugLog)
+	}
+
 	rand.Seed(time.Now().UnixNano())
+
+	// Background workers stop when ctx is done, after finishing what
+	// they're in the middle of.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	var workers sync.WaitGroup
+	runWorker := func(run func(context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(ctx)
+		}()
+	}
+	runWorker(NewScheduler(server, cfg.SchedulerInterval, cfg.ReminderLead, cfg.FollowupDelay).Run)
+	if cfg.ReconcileInterval > 0 {
+		runWorker(NewReconciler(server, cfg.ReconcileInterval, cfg.ReconcileLookback).Run)
+	}
+
 	m := http.NewServeMux()
-	m.Handle("/checkout", &logHandler{requestLog, server.HandleCheckout})
-	m.Handle("/thankyou", &logHandler{requestLog, server.HandleConfirmation})
-	m.Handle("/", &logHandler{requestLog, server.HandleDefault})
-	http.ListenAndServe(fmt.Sprintf(":%d", *port), m)
+	handle := func(route string, h handlerFunc) {
+		m.Handle(route, &logHandler{requestLog, route, h, alerter, server.clientIP})
+	}
+	handle("/checkout", server.HandleCheckout)
+	handle("/thankyou", server.HandleConfirmation)
+	handle("/guide/tours", server.HandleGuideTours)
+	handle("/waiver", server.HandleWaiver)
+	handle("/feedback", server.HandleFeedback)
+	handle("/calendar.ics", server.HandleCalendar)
+	handle("/admin/teams", server.HandleAdminTeams)
+	handle("/admin/planner", server.HandleAdminPlanner)
+	handle("/admin/riders", server.HandleAdminRiders)
+	handle("/admin/waivers", server.HandleAdminWaivers)
+	handle("/admin/feedback", server.HandleAdminFeedback)
+	handle("/admin/notify", server.HandleAdminNotify)
+	handle("/admin/cancel", server.HandleAdminCancel)
+	handle("/", server.HandleDefault)
+	m.HandleFunc("/metrics", server.HandleMetrics)
+	m.HandleFunc("/healthz", server.HandleHealth)
+	m.HandleFunc("/readyz", server.HandleReady)
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", cfg.Port),
+		Handler:      NewSecurityHeaders(m, cfg.BaseURL, cfg.CSPReportOnly),
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+		ErrorLog:     debugLog,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop() // a second signal kills the process
+	debugLog.Printf("Shutting down")
+	server.draining.Store(true)
+	time.Sleep(cfg.ShutdownDelay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	// Shutdown waits for in-flight requests such as checkouts.
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		debugLog.Printf("Error shutting down HTTP server: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		alerter.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		debugLog.Printf("Gave up waiting for background work")
+	}
 }
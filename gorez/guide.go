@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// GuideToursVars represents the query parameters of a guide's link.
+type GuideToursVars struct {
+	Guide string
+	Token string
+}
+
+// GuideToursData is the data passed to the guide tours template.
+type GuideToursData struct {
+	Page
+	Guide    string
+	Tours    []*GuideTour
+	Warnings map[warning]bool
+}
+
+// guideLink returns the link that shows a guide their tours, or "" if
+// links can't be signed.  Each guide has their own link, signed with
+// their name, so one guide can't see another's riders.  Changing the
+// signing key revokes every link.
+func (s *Server) guideLink(guide string) string {
+	token := s.sign("guide", guide)
+	if token == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/guide/tours?%s", s.baseURL, url.Values{"Guide": {guide}, "Token": {token}}.Encode())
+}
+
+func (s *Server) guideTours(r *http.Request) (*GuideToursData, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if err := r.ParseForm(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars GuideToursVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	guide := strings.TrimSpace(vars.Guide)
+	if guide == "" || !s.verify(vars.Token, "guide", guide) {
+		return nil, warnings, &appError{http.StatusForbidden, "This link is invalid; please ask the office for your guide link", nil}
+	}
+	// Links don't expire, so also check the name is still in Guides.
+	ok, err := s.store.IsGuide(r.Context(), guide)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("IsGuide: %v", err)}
+	}
+	if !ok {
+		return nil, warnings, &appError{http.StatusForbidden, "This link is invalid; please ask the office for your guide link", fmt.Errorf("%q is not a guide", guide)}
+	}
+
+	// Start from midnight so that tours earlier today still show.
+	now := time.Now().In(s.timeZone)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.timeZone)
+	until := from.AddDate(0, 0, guideDays)
+	tours, err := s.store.GetGuideTours(r.Context(), guide, from)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetGuideTours: %v", err)}
+	}
+	data := &GuideToursData{
+		Page:     staffPage(r),
+		Guide:    guide,
+		Warnings: warnings,
+	}
+	for _, t := range tours {
+		if !t.Time.Before(until) {
+			break // tours are sorted by time
+		}
+		// A failure on one tour shouldn't hide the others, so we
+		// record a warning and show what we have.
+		if t.Teams, err = s.store.GetTeams(r.Context(), t.ID); err != nil {
+			s.log.Printf("GetTeams: %v", err)
+			warnings[WarningGetTeams] = true
+		}
+		if t.Roster, err = s.store.GetRoster(r.Context(), t.ID); err != nil {
+			s.log.Printf("GetRoster: %v", err)
+			warnings[WarningGetRoster] = true
+		}
+		data.Tours = append(data.Tours, t)
+	}
+	return data, warnings, nil
+}
+
+// TotalRiders returns the number of riders across the roster.
+func (t *GuideTour) TotalRiders() int {
+	n := 0
+	for _, e := range t.Roster {
+		n += e.NumRiders
+	}
+	return n
+}
+
+func (s *Server) HandleGuideTours(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	data, warnings, e := s.guideTours(r)
+	if e != nil {
+		if e.Error != nil {
+			s.log.Printf("%s: %v", e.Message, e.Error)
+		}
+		http.Error(w, e.Message, e.Code)
+		return e.Code, warnings, e.Message
+	}
+	summary = fmt.Sprintf("guide:%q tours:%d", data.Guide, len(data.Tours))
+	tmpl, err := s.templates.Get("guide_tours.html")
+	if err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error parsing guide tours template"
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error executing guide tours template"
+	}
+	return http.StatusOK, warnings, summary
+}
+
+func runGuideLink(s *Server, names []string) int {
+	status := 0
+	for _, name := range names {
+		ok, err := s.store.IsGuide(context.Background(), name)
+		switch {
+		case err != nil:
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		case !ok:
+			fmt.Fprintf(os.Stderr, "%q has never been assigned to a tour\n", name)
+			status = 1
+		default:
+			link := s.guideLink(name)
+			if link == "" {
+				fmt.Fprintln(os.Stderr, "signing_key is required for guide links")
+				return 2
+			}
+			fmt.Printf("%s\t%s\n", name, link)
+		}
+	}
+	return status
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const readyTimeout = 2 * time.Second // for the database ping
+
+// HandleHealth reports that the process is up.  Like the readiness
+// check it isn't wrapped in logHandler, so probes don't fill the
+// request log.
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// HandleReady reports whether the server can take traffic: the
+// database answers, the templates are loaded, and it isn't shutting
+// down.
+func (s *Server) HandleReady(w http.ResponseWriter, r *http.Request) {
+	if err := s.ready(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) ready(ctx context.Context) error {
+	if s.draining.Load() {
+		return fmt.Errorf("shutting down")
+	}
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	if err := s.store.Ping(ctx); err != nil {
+		return fmt.Errorf("database: %v", err)
+	}
+	if err := s.templates.Check(); err != nil {
+		return fmt.Errorf("page templates: %v", err)
+	}
+	if err := s.emailTemplates.Check(); err != nil {
+		return fmt.Errorf("email templates: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message catalogs map English text, as written in the templates and
+// code, to its translation.  Anything missing is shown in English.
+//
+//go:embed catalogs/*.json
+var embeddedCatalogs embed.FS
+
+const defaultLanguage = "en"
+
+// locale holds how dates, money and messages are shown in a language.
+type locale struct {
+	name      string     // in the language itself, for the language menu
+	days      [7]string  // Sunday first
+	months    [12]string // January first
+	dateTime  string     // time.Format layout; English names are replaced
+	dayMonth  string     // same, for email subjects
+	decimal   string
+	thousands string
+	currency  string // fmt pattern for the formatted amount
+	messages  map[string]string
+}
+
+// languages lists the supported languages in menu order.
+var languages = []string{"en", "es", "fr", "de"}
+
+var locales = map[string]*locale{
+	"en": {
+		name:      "English",
+		days:      [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		months:    [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		dateTime:  "Monday, 2 January 2006 at 3:04 pm",
+		dayMonth:  "January 2",
+		decimal:   ".",
+		thousands: ",",
+		currency:  "$%s",
+	},
+	"es": {
+		name:      "Español",
+		days:      [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		months:    [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		dateTime:  "Monday, 2 de January de 2006, 15:04",
+		dayMonth:  "2 de January",
+		decimal:   ",",
+		thousands: ".",
+		currency:  "%s US$",
+	},
+	"fr": {
+		name:      "Français",
+		days:      [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		months:    [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		dateTime:  "Monday 2 January 2006 à 15h04",
+		dayMonth:  "2 January",
+		decimal:   ",",
+		thousands: "\u202f", // narrow no-break space
+		currency:  "%s $US",
+	},
+	"de": {
+		name:      "Deutsch",
+		days:      [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		months:    [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		dateTime:  "Monday, 2. January 2006 um 15:04 Uhr",
+		dayMonth:  "2. January",
+		decimal:   ",",
+		thousands: ".",
+		currency:  "%s $",
+	},
+}
+
+// loadCatalogs reads the message catalog for each language other than
+// English, checking that every translation takes the same arguments as
+// the English text.
+func loadCatalogs() error {
+	for _, lang := range languages {
+		if lang == defaultLanguage {
+			continue
+		}
+		b, err := embeddedCatalogs.ReadFile(path.Join("catalogs", lang+".json"))
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(b, &messages); err != nil {
+			return fmt.Errorf("catalog %s: %v", lang, err)
+		}
+		for msg, translation := range messages {
+			if verbs(msg) != verbs(translation) {
+				return fmt.Errorf("catalog %s: %q doesn't match the arguments of %q", lang, translation, msg)
+			}
+		}
+		locales[lang].messages = messages
+	}
+	return nil
+}
+
+// verbs returns the fmt verbs in s, e.g. "%s%d".
+func verbs(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s)-1; i++ {
+		if s[i] == '%' {
+			b.WriteString(s[i : i+2])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// language picks the language for a customer page: the lang form
+// value if we support it, else the best match for the browser's
+// Accept-Language header, else English.
+func language(r *http.Request) string {
+	if lang := r.FormValue("lang"); locales[lang] != nil {
+		return lang
+	}
+	best, bestQ := defaultLanguage, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			tag = part[:i]
+			param := strings.TrimSpace(part[i+1:])
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+				continue
+			}
+		}
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if i := strings.IndexByte(tag, '-'); i >= 0 {
+			tag = tag[:i]
+		}
+		if locales[tag] != nil && q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// localizedName returns the name of a template's translation, e.g.
+// "customer.es.txt" for "customer.txt".
+func localizedName(name, lang string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + lang + ext
+}
+
+func (p Page) locale() *locale {
+	if l := locales[p.Lang]; l != nil {
+		return l
+	}
+	return locales[defaultLanguage]
+}
+
+// T translates msg and, if there are any args, formats them into it.
+func (p Page) T(msg string, args ...interface{}) string {
+	if translation, ok := p.locale().messages[msg]; ok {
+		msg = translation
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// HTML is like T for messages containing markup.  The args are
+// escaped; the catalogs are trusted.
+func (p Page) HTML(msg string, args ...interface{}) template.HTML {
+	for i, arg := range args {
+		args[i] = template.HTMLEscapeString(fmt.Sprint(arg))
+	}
+	return template.HTML(p.T(msg, args...))
+}
+
+func (p Page) formatTime(t time.Time, layout string) string {
+	l := p.locale()
+	s := t.Format(layout)
+	s = strings.Replace(s, t.Weekday().String(), l.days[t.Weekday()], 1)
+	return strings.Replace(s, t.Month().String(), l.months[t.Month()-1], 1)
+}
+
+// DateTime formats the date and time of a tour.
+func (p Page) DateTime(t time.Time) string {
+	return p.formatTime(t, p.locale().dateTime)
+}
+
+// DayMonth formats a short date, e.g. "January 2".
+func (p Page) DayMonth(t time.Time) string {
+	return p.formatTime(t, p.locale().dayMonth)
+}
+
+// MonthName returns the name of month m, where January is 1.
+func (p Page) MonthName(m int) string {
+	return p.locale().months[m-1]
+}
+
+// Money formats an amount in US dollars given in cents.
+func (p Page) Money(cents int64) string {
+	l := p.locale()
+	whole := strconv.FormatInt(cents/100, 10)
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + l.thousands + whole[i:]
+	}
+	return fmt.Sprintf(l.currency, fmt.Sprintf("%s%s%02d", whole, l.decimal, cents%100))
+}
+
+// LanguageOption is an entry in the language menu.
+type LanguageOption struct {
+	Code    string
+	Name    string
+	Current bool
+}
+
+func (p Page) Languages() []*LanguageOption {
+	var options []*LanguageOption
+	for _, lang := range languages {
+		options = append(options, &LanguageOption{lang, locales[lang].name, lang == p.Lang})
+	}
+	return options
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadCatalogs(t *testing.T) {
+	if err := loadCatalogs(); err != nil {
+		t.Fatalf("loadCatalogs: %v", err)
+	}
+	p := Page{Lang: "es"}
+	if got, want := p.T("Rider #%d", 2), "Ciclista n.º 2"; got != want {
+		t.Errorf("T = %q, want %q", got, want)
+	}
+	if got, want := p.T("not in any catalog"), "not in any catalog"; got != want {
+		t.Errorf("T = %q, want %q", got, want)
+	}
+}
+
+func TestVerbs(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"no verbs", ""},
+		{"%s Tour %s", "%s%s"},
+		{"Rider #%d", "%d"},
+		{"100%% sure", "%%"},
+		{"trailing %", ""},
+	}
+	for _, tt := range tests {
+		if got := verbs(tt.s); got != tt.want {
+			t.Errorf("verbs(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	tests := []struct {
+		query, accept, want string
+	}{
+		{"", "", "en"},
+		{"lang=fr", "de", "fr"},
+		{"lang=xx", "de", "de"},
+		{"", "es-MX,es;q=0.9,en;q=0.8", "es"},
+		{"", "en;q=0.5, de;q=0.7", "de"},
+		{"", "DE-de", "de"},
+		{"", "ja,fr;q=0.2", "fr"},
+		{"", "ja", "en"},
+		{"", "fr;q=bad, es;level=1", "en"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept-Language", tt.accept)
+		}
+		if got := language(r); got != tt.want {
+			t.Errorf("language(%q, Accept-Language %q) = %q, want %q", tt.query, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestMoney(t *testing.T) {
+	tests := []struct {
+		lang  string
+		cents int64
+		want  string
+	}{
+		{"en", 0, "$0.00"},
+		{"en", 4905, "$49.05"},
+		{"en", 123456789, "$1,234,567.89"},
+		{"es", 123456, "1.234,56 US$"},
+		{"fr", 123456, "1\u202f234,56\u00a0$US"},
+		{"de", 99900, "999,00\u00a0$"},
+		{"xx", 100, "$1.00"},
+	}
+	for _, tt := range tests {
+		if got := (Page{Lang: tt.lang}).Money(tt.cents); got != tt.want {
+			t.Errorf("Money(%s, %d) = %q, want %q", tt.lang, tt.cents, got, tt.want)
+		}
+	}
+}
+
+func TestDateTime(t *testing.T) {
+	tm := time.Date(2026, time.May, 3, 14, 30, 0, 0, time.UTC)
+	tests := []struct {
+		lang, want string
+	}{
+		{"en", "Sunday, 3 May 2026 at 2:30 pm"},
+		{"es", "domingo, 3 de mayo de 2026, 14:30"},
+		{"fr", "dimanche 3 mai 2026 à 14h30"},
+		{"de", "Sonntag, 3. Mai 2026 um 14:30 Uhr"},
+	}
+	for _, tt := range tests {
+		if got := (Page{Lang: tt.lang}).DateTime(tm); got != tt.want {
+			t.Errorf("DateTime(%s) = %q, want %q", tt.lang, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Logging policy: both logs are JSON lines so they can be shipped to
+// an aggregator.  Customer details must not reach them.  Form values
+// are logged only for the keys in loggedFormKeys; attributes named in
+// redactedAttrs are dropped, and email addresses and phone numbers are
+// masked wherever else they turn up, e.g. in error messages.
+
+const redacted = "[redacted]"
+
+// loggedFormKeys are form keys whose values are safe to log.  For
+// indexed keys like Riders.0.Height the last component is checked.
+var loggedFormKeys = map[string]bool{
+	"TourId":      true,
+	"TourID":      true,
+	"OrderNum":    true,
+	"NumRiders":   true,
+	"QuotedTotal": true,
+	"Gender":      true,
+	"Height":      true,
+	"Age":         true,
+	"SMSOptIn":    true,
+	"lang":        true,
+	"From":        true,
+	"To":          true,
+	"Saved":       true,
+	"Remedy":      true,
+	"Confirm":     true,
+	"Days":        true,
+	"Rider":       true,
+	"Rating":      true,
+	"Agree":       true,
+	"Version":     true,
+}
+
+// redactedAttrs are attribute keys whose values are never logged.
+var redactedAttrs = map[string]bool{
+	"name":   true,
+	"email":  true,
+	"mobile": true,
+	"phone":  true,
+	"hotel":  true,
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[^\s@<>"'(),;:]+@[^\s@<>"'(),;:]+\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`\+[1-9][0-9]{6,14}`)
+)
+
+// redactText masks email addresses and E.164 phone numbers.
+func redactText(s string) string {
+	s = emailPattern.ReplaceAllString(s, "[email]")
+	return phonePattern.ReplaceAllString(s, "[phone]")
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if redactedAttrs[a.Key] {
+		return slog.String(a.Key, redacted)
+	}
+	if a.Value.Kind() == slog.KindString {
+		return slog.String(a.Key, redactText(a.Value.String()))
+	}
+	if err, ok := a.Value.Any().(error); ok {
+		return slog.String(a.Key, redactText(err.Error()))
+	}
+	return a
+}
+
+// newLogger returns a JSON logger that applies the logging policy.
+// addSource records the file and line of each call.
+func newLogger(w io.Writer, addSource bool) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		AddSource:   addSource,
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+// loggedForm returns the form values for the request log, with values
+// of keys not in loggedFormKeys replaced.
+func loggedForm(form url.Values) map[string]string {
+	if len(form) == 0 {
+		return nil
+	}
+	logged := make(map[string]string, len(form))
+	for key, values := range form {
+		name := key
+		if i := strings.LastIndex(key, "."); i >= 0 {
+			name = key[i+1:]
+		}
+		if loggedFormKeys[name] {
+			logged[key] = strings.Join(values, ",")
+		} else {
+			logged[key] = redacted
+		}
+	}
+	return logged
+}
+
+// summaryIDs extracts the tour and order IDs from a handler's summary,
+// which has fields like "tour:12 order:345".  Missing IDs are zero.
+func summaryIDs(summary string) (tourID, orderID int64) {
+	for _, field := range strings.Fields(summary) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "tour":
+			tourID, _ = strconv.ParseInt(value, 10, 32)
+		case "order":
+			orderID, _ = strconv.ParseInt(value, 10, 32)
+		}
+	}
+	return tourID, orderID
+}
+
+// requestID returns the ID a proxy in front of us assigned to the
+// request, or a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 64 && !strings.ContainsAny(id, " \t\"") {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactText(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"nothing here", "nothing here"},
+		{"mail jane.doe+tours@example.co.uk failed", "mail [email] failed"},
+		{`to "<bob@example.com>"`, `to "<[email]>"`},
+		{"SMS to +12125551234: 400", "SMS to [phone]: 400"},
+		{"order 12345678 for tour 42", "order 12345678 for tour 42"},
+	}
+	for _, tt := range tests {
+		if got := redactText(tt.s); got != tt.want {
+			t.Errorf("redactText(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestLoggedForm(t *testing.T) {
+	form := url.Values{
+		"TourID":          {"12"},
+		"Name":            {"Jane Doe"},
+		"Email":           {"jane@example.com"},
+		"Riders.0.Height": {"64"},
+		"Riders.0.Name":   {"Jane"},
+		"Misc":            {"allergic to bees"},
+		"Days":            {"1", "2"},
+	}
+	want := map[string]string{
+		"TourID":          "12",
+		"Name":            redacted,
+		"Email":           redacted,
+		"Riders.0.Height": "64",
+		"Riders.0.Name":   redacted,
+		"Misc":            redacted,
+		"Days":            "1,2",
+	}
+	if got := loggedForm(form); !reflect.DeepEqual(got, want) {
+		t.Errorf("loggedForm = %v, want %v", got, want)
+	}
+	if got := loggedForm(nil); got != nil {
+		t.Errorf("loggedForm(nil) = %v, want nil", got)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	newLogger(&buf, false).Error("send failed",
+		"email", "jane@example.com",
+		"tour", 12,
+		"error", errors.New("mailbox jane@example.com full"),
+		"detail", "call +12125551234")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line %q: %v", buf.String(), err)
+	}
+	for key, want := range map[string]interface{}{
+		"msg":    "send failed",
+		"email":  redacted,
+		"tour":   12.0,
+		"error":  "mailbox [email] full",
+		"detail": "call [phone]",
+	} {
+		if entry[key] != want {
+			t.Errorf("%s = %v, want %v", key, entry[key], want)
+		}
+	}
+	if strings.Contains(buf.String(), "jane@example.com") {
+		t.Errorf("log line %q contains an email address", buf.String())
+	}
+}
+
+func TestDebugLogger(t *testing.T) {
+	var buf bytes.Buffer
+	debugLog := slog.NewLogLogger(newLogger(&buf, true).Handler(), slog.LevelInfo)
+	debugLog.Printf("CreateOrder: %v", errors.New("duplicate entry 'jane@example.com'"))
+	if !strings.Contains(buf.String(), "duplicate entry '[email]'") {
+		t.Errorf("log line %q, want the email address masked", buf.String())
+	}
+}
+
+func TestSummaryIDs(t *testing.T) {
+	tests := []struct {
+		summary             string
+		wantTour, wantOrder int64
+	}{
+		{"", 0, 0},
+		{"tour:12 order:345", 12, 345},
+		{"order:345 riders:2", 0, 345},
+		{"tour:abc order:", 0, 0},
+	}
+	for _, tt := range tests {
+		tour, order := summaryIDs(tt.summary)
+		if tour != tt.wantTour || order != tt.wantOrder {
+			t.Errorf("summaryIDs(%q) = %d, %d, want %d, %d", tt.summary, tour, order, tt.wantTour, tt.wantOrder)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Request-Id", "abc-123")
+	if got := requestID(r); got != "abc-123" {
+		t.Errorf("requestID = %q, want the proxy's abc-123", got)
+	}
+	r.Header.Set("X-Request-Id", `bad "id"`)
+	if got := requestID(r); len(got) != 16 {
+		t.Errorf("requestID = %q, want a new 16-digit ID", got)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gorez_requests_total",
+		Help: "Requests handled, by route and status code.",
+	}, []string{"route", "code"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gorez_request_duration_seconds",
+		Help:    "Time taken to handle requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	warningsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gorez_warnings_total",
+		Help: "Warnings raised while handling requests, e.g. input_bad/tour_full.",
+	}, []string{"warning"})
+
+	bookingsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gorez_bookings_total",
+		Help: "Paid bookings, by tour code.",
+	}, []string{"tour_code"})
+	bookedRidersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gorez_booked_riders_total",
+		Help: "Riders in paid bookings, by tour code.",
+	}, []string{"tour_code"})
+	revenueTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gorez_revenue_dollars_total",
+		Help: "Amount charged for bookings, by tour code.  Refunds aren't subtracted.",
+	}, []string{"tour_code"})
+
+	dependencyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gorez_dependency_duration_seconds",
+		Help:    "Time taken by calls to Stripe, SendGrid and MySQL.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"dependency", "operation"})
+	dependencyErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gorez_dependency_errors_total",
+		Help: "Failed calls to Stripe, SendGrid and MySQL.  Declined cards aren't counted.",
+	}, []string{"dependency", "operation"})
+)
+
+var metricsHandler = promhttp.Handler()
+
+// recordRequest updates the request metrics; logHandler calls it for
+// every request.
+func recordRequest(route string, code int, elapsed time.Duration, warnings map[warning]bool) {
+	requestsTotal.WithLabelValues(route, strconv.Itoa(code)).Inc()
+	requestDuration.WithLabelValues(route).Observe(elapsed.Seconds())
+	for w, ok := range warnings {
+		if ok {
+			warningsTotal.WithLabelValues(string(w)).Inc()
+		}
+	}
+}
+
+// recordBooking counts a booking once its card has been charged.
+func recordBooking(tourCode string, numRiders int, cents int64) {
+	bookingsTotal.WithLabelValues(tourCode).Inc()
+	bookedRidersTotal.WithLabelValues(tourCode).Add(float64(numRiders))
+	revenueTotal.WithLabelValues(tourCode).Add(float64(cents) / 100)
+}
+
+// observe records a call to a dependency that started at start.
+func observe(dependency, operation string, start time.Time, err error) {
+	dependencyDuration.WithLabelValues(dependency, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dependencyErrors.WithLabelValues(dependency, operation).Inc()
+	}
+}
+
+// HandleMetrics serves the metrics to Prometheus, which should scrape
+// with the admin password.  It isn't wrapped in logHandler, so scrapes
+// don't fill the request log.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		s.handleAdminError(w, &appError{http.StatusUnauthorized, "Unauthorized", nil})
+		return
+	}
+	metricsHandler.ServeHTTP(w, r)
+}
+
+// metricsPayments times calls to another Payments.
+type metricsPayments struct {
+	Payments
+}
+
+func (m *metricsPayments) Charge(ctx context.Context, orderID int32, name, email, token string, amount int64) (string, error) {
+	start := time.Now()
+	chargeID, err := m.Payments.Charge(ctx, orderID, name, email, token, amount)
+	if _, declined := cardDeclined(err); declined {
+		observe("stripe", "Charge", start, nil)
+	} else {
+		observe("stripe", "Charge", start, err)
+	}
+	return chargeID, err
+}
+
+func (m *metricsPayments) Refund(ctx context.Context, orderID int32, chargeID string) (string, error) {
+	start := time.Now()
+	refundID, err := m.Payments.Refund(ctx, orderID, chargeID)
+	observe("stripe", "Refund", start, err)
+	return refundID, err
+}
+
+func (m *metricsPayments) ListCharges(ctx context.Context, since time.Time) ([]*Charge, error) {
+	start := time.Now()
+	charges, err := m.Payments.ListCharges(ctx, since)
+	observe("stripe", "ListCharges", start, err)
+	return charges, err
+}
+
+// metricsStore times calls to another Store.
+type metricsStore struct {
+	Store
+}
+
+func (m *metricsStore) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := m.Store.Ping(ctx)
+	observe("mysql", "Ping", start, err)
+	return err
+}
+
+func (m *metricsStore) GetTourDetailByID(ctx context.Context, tourID int32, maxRiders int) (*TourDetail, bool, error) {
+	start := time.Now()
+	tourDetail, ok, err := m.Store.GetTourDetailByID(ctx, tourID, maxRiders)
+	observe("mysql", "GetTourDetailByID", start, err)
+	return tourDetail, ok, err
+}
+
+func (m *metricsStore) GetUpcomingTours(ctx context.Context, from, until time.Time, maxRiders int) ([]*TourDetail, error) {
+	start := time.Now()
+	tours, err := m.Store.GetUpcomingTours(ctx, from, until, maxRiders)
+	observe("mysql", "GetUpcomingTours", start, err)
+	return tours, err
+}
+
+func (m *metricsStore) GetPendingRiders(ctx context.Context, tourID int32, since time.Time) (int, error) {
+	start := time.Now()
+	n, err := m.Store.GetPendingRiders(ctx, tourID, since)
+	observe("mysql", "GetPendingRiders", start, err)
+	return n, err
+}
+
+func (m *metricsStore) GetTeams(ctx context.Context, tourID int32) ([]*Team, error) {
+	start := time.Now()
+	teams, err := m.Store.GetTeams(ctx, tourID)
+	observe("mysql", "GetTeams", start, err)
+	return teams, err
+}
+
+func (m *metricsStore) GetTeamVersions(ctx context.Context, tourID int32) ([]int, error) {
+	start := time.Now()
+	versions, err := m.Store.GetTeamVersions(ctx, tourID)
+	observe("mysql", "GetTeamVersions", start, err)
+	return versions, err
+}
+
+func (m *metricsStore) GetTeamsVersion(ctx context.Context, tourID int32, version int) ([]*Team, error) {
+	start := time.Now()
+	teams, err := m.Store.GetTeamsVersion(ctx, tourID, version)
+	observe("mysql", "GetTeamsVersion", start, err)
+	return teams, err
+}
+
+func (m *metricsStore) CreateTeamsVersion(ctx context.Context, tourID int32, teams []*Team) (int, []*Team, error) {
+	start := time.Now()
+	n, previous, err := m.Store.CreateTeamsVersion(ctx, tourID, teams)
+	observe("mysql", "CreateTeamsVersion", start, err)
+	return n, previous, err
+}
+
+func (m *metricsStore) GetGuideEmails(ctx context.Context, names []string) (map[string]string, error) {
+	start := time.Now()
+	emails, err := m.Store.GetGuideEmails(ctx, names)
+	observe("mysql", "GetGuideEmails", start, err)
+	return emails, err
+}
+
+func (m *metricsStore) IsGuide(ctx context.Context, name string) (bool, error) {
+	start := time.Now()
+	ok, err := m.Store.IsGuide(ctx, name)
+	observe("mysql", "IsGuide", start, err)
+	return ok, err
+}
+
+func (m *metricsStore) GetGuideTours(ctx context.Context, guide string, from time.Time) ([]*GuideTour, error) {
+	start := time.Now()
+	tours, err := m.Store.GetGuideTours(ctx, guide, from)
+	observe("mysql", "GetGuideTours", start, err)
+	return tours, err
+}
+
+func (m *metricsStore) GetRoster(ctx context.Context, tourID int32) ([]*RosterEntry, error) {
+	start := time.Now()
+	roster, err := m.Store.GetRoster(ctx, tourID)
+	observe("mysql", "GetRoster", start, err)
+	return roster, err
+}
+
+func (m *metricsStore) GetBikeStock(ctx context.Context, location string) (map[string]int, error) {
+	start := time.Now()
+	stock, err := m.Store.GetBikeStock(ctx, location)
+	observe("mysql", "GetBikeStock", start, err)
+	return stock, err
+}
+
+func (m *metricsStore) GetBookedRiders(ctx context.Context, location string, t time.Time, excludeOrderID int32) ([]Rider, error) {
+	start := time.Now()
+	riders, err := m.Store.GetBookedRiders(ctx, location, t, excludeOrderID)
+	observe("mysql", "GetBookedRiders", start, err)
+	return riders, err
+}
+
+func (m *metricsStore) GetOrderRiders(ctx context.Context, orderID int32) ([]Rider, error) {
+	start := time.Now()
+	riders, err := m.Store.GetOrderRiders(ctx, orderID)
+	observe("mysql", "GetOrderRiders", start, err)
+	return riders, err
+}
+
+func (m *metricsStore) CreateOrder(ctx context.Context, tourID int32, numRiders int, riders []Rider, total int64, name, email, mobile, hotel, misc string, contacts OrderContacts) (int32, error) {
+	start := time.Now()
+	orderID, err := m.Store.CreateOrder(ctx, tourID, numRiders, riders, total, name, email, mobile, hotel, misc, contacts)
+	observe("mysql", "CreateOrder", start, err)
+	return orderID, err
+}
+
+func (m *metricsStore) GetWebOrders(ctx context.Context, since time.Time) ([]*WebOrder, error) {
+	start := time.Now()
+	orders, err := m.Store.GetWebOrders(ctx, since)
+	observe("mysql", "GetWebOrders", start, err)
+	return orders, err
+}
+
+func (m *metricsStore) GetOrder(ctx context.Context, orderID int32) (*Order, bool, error) {
+	start := time.Now()
+	order, ok, err := m.Store.GetOrder(ctx, orderID)
+	observe("mysql", "GetOrder", start, err)
+	return order, ok, err
+}
+
+func (m *metricsStore) UpdateOrderPaymentRecorded(ctx context.Context, orderID int32, chargeID string, amount int64) error {
+	start := time.Now()
+	err := m.Store.UpdateOrderPaymentRecorded(ctx, orderID, chargeID, amount)
+	observe("mysql", "UpdateOrderPaymentRecorded", start, err)
+	return err
+}
+
+func (m *metricsStore) UpdateOrderConfirmationSent(ctx context.Context, orderID int32) error {
+	start := time.Now()
+	err := m.Store.UpdateOrderConfirmationSent(ctx, orderID)
+	observe("mysql", "UpdateOrderConfirmationSent", start, err)
+	return err
+}
+
+func (m *metricsStore) GetTourOrders(ctx context.Context, tourID int32) ([]*Order, error) {
+	start := time.Now()
+	orders, err := m.Store.GetTourOrders(ctx, tourID)
+	observe("mysql", "GetTourOrders", start, err)
+	return orders, err
+}
+
+func (m *metricsStore) GetTourPayments(ctx context.Context, tourID int32) (map[int32]*Payment, error) {
+	start := time.Now()
+	payments, err := m.Store.GetTourPayments(ctx, tourID)
+	observe("mysql", "GetTourPayments", start, err)
+	return payments, err
+}
+
+func (m *metricsStore) UpdatePaymentRefunded(ctx context.Context, orderID int32, refundID string, refundedAt time.Time) error {
+	start := time.Now()
+	err := m.Store.UpdatePaymentRefunded(ctx, orderID, refundID, refundedAt)
+	observe("mysql", "UpdatePaymentRefunded", start, err)
+	return err
+}
+
+func (m *metricsStore) UpdateTourCancelled(ctx context.Context, tourID int32) error {
+	start := time.Now()
+	err := m.Store.UpdateTourCancelled(ctx, tourID)
+	observe("mysql", "UpdateTourCancelled", start, err)
+	return err
+}
+
+func (m *metricsStore) GetNoticeOrders(ctx context.Context, kind string, tourFrom, tourUntil time.Time, minNotice time.Duration, staleClaim time.Time) ([]*Order, error) {
+	start := time.Now()
+	orders, err := m.Store.GetNoticeOrders(ctx, kind, tourFrom, tourUntil, minNotice, staleClaim)
+	observe("mysql", "GetNoticeOrders", start, err)
+	return orders, err
+}
+
+func (m *metricsStore) ClaimNotice(ctx context.Context, orderID int32, kind, instance string, now, staleClaim time.Time) (bool, error) {
+	start := time.Now()
+	ok, err := m.Store.ClaimNotice(ctx, orderID, kind, instance, now, staleClaim)
+	observe("mysql", "ClaimNotice", start, err)
+	return ok, err
+}
+
+func (m *metricsStore) UpdateNoticeSent(ctx context.Context, orderID int32, kind string, sentAt time.Time) error {
+	start := time.Now()
+	err := m.Store.UpdateNoticeSent(ctx, orderID, kind, sentAt)
+	observe("mysql", "UpdateNoticeSent", start, err)
+	return err
+}
+
+func (m *metricsStore) SaveFeedback(ctx context.Context, fb *Feedback) error {
+	start := time.Now()
+	err := m.Store.SaveFeedback(ctx, fb)
+	observe("mysql", "SaveFeedback", start, err)
+	return err
+}
+
+func (m *metricsStore) GetFeedback(ctx context.Context, since time.Time) ([]*Feedback, error) {
+	start := time.Now()
+	feedback, err := m.Store.GetFeedback(ctx, since)
+	observe("mysql", "GetFeedback", start, err)
+	return feedback, err
+}
+
+func (m *metricsStore) CreateWaiverSignature(ctx context.Context, sig *WaiverSignature) (bool, error) {
+	start := time.Now()
+	ok, err := m.Store.CreateWaiverSignature(ctx, sig)
+	observe("mysql", "CreateWaiverSignature", start, err)
+	return ok, err
+}
+
+func (m *metricsStore) GetOrderWaivers(ctx context.Context, orderID int32) ([]*WaiverSignature, error) {
+	start := time.Now()
+	sigs, err := m.Store.GetOrderWaivers(ctx, orderID)
+	observe("mysql", "GetOrderWaivers", start, err)
+	return sigs, err
+}
+
+func (m *metricsStore) GetTourWaivers(ctx context.Context, tourID int32) ([]*WaiverSignature, error) {
+	start := time.Now()
+	sigs, err := m.Store.GetTourWaivers(ctx, tourID)
+	observe("mysql", "GetTourWaivers", start, err)
+	return sigs, err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const smsPrefix = "Bike the Big Apple: "
+
+const (
+	// Admin actions on every order of a tour work on this many orders
+	// at a time, and stop starting new ones after bulkDeadline so the
+	// page is shown before the server's write timeout.
+	bulkWorkers  = 8
+	bulkDeadline = 90 * time.Second
+
+	outOfTime = "not attempted: ran out of time"
+)
+
+// NotifyResult is the outcome of notifying one order.
+type NotifyResult struct {
+	Order  *Order
+	Status string
+	OK     bool
+}
+
+// AdminNotifyVars represents the form inputs.
+type AdminNotifyVars struct {
+	TourID    int32 `schema:"TourId"`
+	Message   string
+	CSRFToken string
+}
+
+// AdminNotifyData is the data passed to the admin notify template.
+type AdminNotifyData struct {
+	Page
+	TourDetail *TourDetail
+	CSRFToken  string // also set in a cookie
+	SMSEnabled bool
+	Message    string
+	Results    []*NotifyResult // nil until a message is sent
+	Sent       int
+}
+
+// forEachOrder calls f for each order, bulkWorkers at a time, until
+// bulkDeadline has passed.  Calls already started finish.  It reports
+// which orders f was called for.
+func forEachOrder(orders []*Order, f func(i int, o *Order)) []bool {
+	done := make([]bool, len(orders))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < bulkWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i, orders[i])
+				done[i] = true
+			}
+		}()
+	}
+	deadline := time.NewTimer(bulkDeadline)
+	defer deadline.Stop()
+loop:
+	for i := range orders {
+		select {
+		case next <- i:
+		case <-deadline.C:
+			break loop
+		}
+	}
+	close(next)
+	wg.Wait()
+	return done
+}
+
+// textTour sends message to every order on a tour that opted in to
+// texts.  Orders that didn't opt in are reported but not contacted.
+// Texts already being sent finish even if ctx is cancelled; orders
+// not reached by bulkDeadline are reported as such.
+func (s *Server) textTour(ctx context.Context, orders []*Order, message string) []*NotifyResult {
+	ctx = context.WithoutCancel(ctx)
+	results := make([]*NotifyResult, len(orders))
+	done := forEachOrder(orders, func(i int, o *Order) {
+		result := &NotifyResult{Order: o}
+		if o.SMSNumber == "" {
+			result.Status = "not opted in"
+		} else if err := s.sms.SendSMS(ctx, o.SMSNumber, smsPrefix+message); err != nil {
+			s.log.Printf("Error texting order %d: %v", o.ID, err)
+			result.Status = fmt.Sprintf("failed: %v", err)
+		} else {
+			result.Status, result.OK = "sent", true
+		}
+		results[i] = result
+	})
+	for i, o := range orders {
+		if !done[i] {
+			results[i] = &NotifyResult{Order: o, Status: outOfTime}
+		}
+	}
+	return results
+}
+
+func (s *Server) adminNotify(r *http.Request) (*AdminNotifyData, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if !s.isAdmin(r) {
+		return nil, warnings, &appError{http.StatusUnauthorized, "Unauthorized", nil}
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars AdminNotifyVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	token, e := adminCSRF(r, vars.CSRFToken)
+	if e != nil {
+		return nil, warnings, e
+	}
+	tourDetail, ok, err := s.store.GetTourDetailByID(r.Context(), vars.TourID, maxRiders)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourDetailByID: %v", err)}
+	}
+	if !ok {
+		return nil, warnings, &appError{http.StatusBadRequest, fmt.Sprintf("Invalid tour ID %d", vars.TourID), nil}
+	}
+	data := &AdminNotifyData{
+		Page:       staffPage(r),
+		TourDetail: tourDetail,
+		CSRFToken:  token,
+		SMSEnabled: s.sms != nil,
+		Message:    strings.TrimSpace(vars.Message),
+	}
+	if r.Method != "POST" || data.Message == "" || !data.SMSEnabled {
+		return data, warnings, nil
+	}
+	orders, err := s.store.GetTourOrders(r.Context(), vars.TourID)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourOrders: %v", err)}
+	}
+	data.Results = s.textTour(r.Context(), orders, data.Message)
+	for _, result := range data.Results {
+		if result.OK {
+			data.Sent++
+		}
+	}
+	return data, warnings, nil
+}
+
+func (s *Server) HandleAdminNotify(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	data, warnings, e := s.adminNotify(r)
+	if e != nil {
+		s.handleAdminError(w, e)
+		return e.Code, warnings, e.Message
+	}
+	summary = fmt.Sprintf("tour:%d", data.TourDetail.ID)
+	if data.Results != nil {
+		summary += fmt.Sprintf(" texted:%d/%d", data.Sent, len(data.Results))
+	}
+	tmpl, err := s.templates.Get("admin_notify.html")
+	if err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error parsing admin notify template"
+	}
+	s.setCSRFCookie(w, data.CSRFToken)
+	if err := tmpl.Execute(w, data); err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error executing admin notify template"
+	}
+	return http.StatusOK, warnings, summary
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEachOrder(t *testing.T) {
+	orders := make([]*Order, 50)
+	for i := range orders {
+		orders[i] = &Order{}
+	}
+	var mu sync.Mutex
+	seen := make(map[*Order]int)
+	running, maxRunning := 0, 0
+	done := forEachOrder(orders, func(i int, o *Order) {
+		mu.Lock()
+		seen[o]++
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	for i, o := range orders {
+		if !done[i] || seen[o] != 1 {
+			t.Errorf("order %d: done %v, called %d times; want once", i, done[i], seen[o])
+		}
+	}
+	if maxRunning > bulkWorkers {
+		t.Errorf("%d calls ran at once, want at most %d", maxRunning, bulkWorkers)
+	}
+	if done := forEachOrder(nil, func(int, *Order) { t.Error("called for no orders") }); len(done) != 0 {
+		t.Errorf("forEachOrder(nil) = %v", done)
+	}
+}
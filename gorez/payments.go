@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/charge"
+	"github.com/stripe/stripe-go/customer"
+	"github.com/stripe/stripe-go/refund"
+)
+
+// Payments charges customers' cards and refunds the charges.  Amounts
+// are in cents.  Each call gives up after stripeTimeout, except that
+// once a charge is requested Charge waits for Stripe's answer.
+type Payments interface {
+	// Charge returns the ID of the new charge.  Callers should not
+	// let ctx be cancelled once they decide to charge; see confirm.
+	Charge(ctx context.Context, orderID int32, name, email, token string, amount int64) (string, error)
+	// Refund refunds a charge in full and returns the refund's ID.
+	// Refunding the same charge twice is harmless.
+	Refund(ctx context.Context, orderID int32, chargeID string) (string, error)
+	// ListCharges returns the successful charges made since the given
+	// time, for reconciling against orders.
+	ListCharges(ctx context.Context, since time.Time) ([]*Charge, error)
+}
+
+// Charge is a successful card charge as seen by the payment provider.
+type Charge struct {
+	ID       string
+	OrderID  int32 // from the charge's metadata; zero if missing
+	Amount   int64 // cents
+	Created  time.Time
+	Refunded bool // in full
+}
+
+// StripePayments implements Payments using Stripe.
+type StripePayments struct {
+	secretKey string
+}
+
+func NewStripePayments(secretKey string) *StripePayments {
+	return &StripePayments{secretKey}
+}
+
+func (p *StripePayments) Charge(ctx context.Context, orderID int32, name, email, token string, amount int64) (string, error) {
+	stripe.Key = p.secretKey
+	customerCtx, cancel := context.WithTimeout(ctx, stripeTimeout)
+	defer cancel()
+	customerParams := &stripe.CustomerParams{
+		Params:      stripe.Params{Context: customerCtx},
+		Description: stripe.String(name),
+		Email:       stripe.String(email),
+		Source:      &stripe.SourceParams{Token: stripe.String(token)},
+	}
+	customer, err := customer.New(customerParams)
+	if err != nil {
+		return "", err
+	}
+	// No deadline here: a charge that went through after we stopped
+	// waiting would leave the order uncompleted and unconfirmed.
+	chargeParams := &stripe.ChargeParams{
+		Params:   stripe.Params{Context: ctx},
+		Amount:   stripe.Int64(amount),
+		Currency: stripe.String("USD"),
+		Customer: stripe.String(customer.ID),
+	}
+	chargeParams.AddMetadata("OrderNum", strconv.Itoa(int(orderID)))
+	// A request repeated after a network error can't charge the order
+	// twice.
+	chargeParams.SetIdempotencyKey("charge-" + strconv.Itoa(int(orderID)))
+	ch, err := charge.New(chargeParams)
+	if err != nil {
+		return "", err
+	}
+	return ch.ID, nil
+}
+
+func (p *StripePayments) Refund(ctx context.Context, orderID int32, chargeID string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, stripeTimeout)
+	defer cancel()
+	stripe.Key = p.secretKey
+	refundParams := &stripe.RefundParams{
+		Params: stripe.Params{Context: ctx},
+		Charge: stripe.String(chargeID),
+	}
+	refundParams.AddMetadata("OrderNum", strconv.Itoa(int(orderID)))
+	// Stripe returns the original refund if this key is reused.
+	refundParams.SetIdempotencyKey("refund-" + chargeID)
+	r, err := refund.New(refundParams)
+	if err != nil {
+		return "", err
+	}
+	return r.ID, nil
+}
+
+func (p *StripePayments) ListCharges(ctx context.Context, since time.Time) ([]*Charge, error) {
+	ctx, cancel := context.WithTimeout(ctx, stripeTimeout)
+	defer cancel()
+	stripe.Key = p.secretKey
+	params := &stripe.ChargeListParams{
+		ListParams:   stripe.ListParams{Context: ctx},
+		CreatedRange: &stripe.RangeQueryParams{GreaterThanOrEqual: since.Unix()},
+	}
+	var charges []*Charge
+	it := charge.List(params)
+	for it.Next() {
+		ch := it.Charge()
+		if !ch.Paid || ch.Status != "succeeded" {
+			continue
+		}
+		orderID, _ := strconv.ParseInt(ch.Metadata["OrderNum"], 10, 32)
+		charges = append(charges, &Charge{
+			ID:       ch.ID,
+			OrderID:  int32(orderID),
+			Amount:   ch.Amount,
+			Created:  time.Unix(ch.Created, 0),
+			Refunded: ch.Refunded,
+		})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return charges, nil
+}
+
+// cardDeclined returns the message to show the customer if err means
+// their card was declined.
+func cardDeclined(err error) (string, bool) {
+	if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Code == stripe.ErrorCodeCardDeclined {
+		return stripeErr.Msg, true
+	}
+	return "", false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRidersPerTeam = 10
+	pendingWindow        = 30 * time.Minute // unpaid orders younger than this count as pending
+)
+
+// teamRatios maps tour codes to the number of riders one guide/sweep
+// team can lead.  Tour codes not in the map use the default.
+type teamRatios struct {
+	def    int
+	byCode map[string]int
+}
+
+// parseTeamRatios parses a list like "10,CPN=8,BKN=12", where the
+// optional bare number is the default for all other tour codes.
+func parseTeamRatios(s string) (*teamRatios, error) {
+	t := &teamRatios{defaultRidersPerTeam, make(map[string]int)}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		code, value := "", f
+		if i := strings.Index(f, "="); i >= 0 {
+			code, value = strings.TrimSpace(f[:i]), strings.TrimSpace(f[i+1:])
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid riders per team %q", f)
+		}
+		if code == "" {
+			t.def = n
+		} else {
+			t.byCode[code] = n
+		}
+	}
+	return t, nil
+}
+
+// ridersPerTeam returns the ratio for a tour code.
+func (t *teamRatios) ridersPerTeam(code string) int {
+	if n, ok := t.byCode[code]; ok {
+		return n
+	}
+	return t.def
+}
+
+// teamsNeeded returns the number of teams required to lead riders on
+// a tour with the given code.
+func (t *teamRatios) teamsNeeded(code string, riders int) int {
+	if riders <= 0 {
+		return 0
+	}
+	n := t.ridersPerTeam(code)
+	return (riders + n - 1) / n
+}
+
+// TeamPlan is the planner's view of one tour.
+type TeamPlan struct {
+	TourDetail  *TourDetail
+	Pending     int // riders in unpaid orders placed within pendingWindow
+	Assigned    int // teams currently assigned
+	Needed      int // teams needed for confirmed plus pending riders
+	NeedsTeam   bool
+	RidersLimit int // riders the assigned teams can lead
+}
+
+// planTeams works out how many teams a tour needs.
+func (s *Server) planTeams(tourDetail *TourDetail, pending, assigned int) *TeamPlan {
+	needed := s.teamRatios.teamsNeeded(tourDetail.Code, tourDetail.TotalRiders+pending)
+	return &TeamPlan{
+		TourDetail:  tourDetail,
+		Pending:     pending,
+		Assigned:    assigned,
+		Needed:      needed,
+		NeedsTeam:   needed > assigned,
+		RidersLimit: assigned * s.teamRatios.ridersPerTeam(tourDetail.Code),
+	}
+}
+
+// AdminPlannerData is the data passed to the admin planner template.
+type AdminPlannerData struct {
+	Page
+	Plans    []*TeamPlan
+	Warnings map[warning]bool
+}
+
+func (s *Server) adminPlanner(r *http.Request) (*AdminPlannerData, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if !s.isAdmin(r) {
+		return nil, warnings, &appError{http.StatusUnauthorized, "Unauthorized", nil}
+	}
+	now := time.Now().In(s.timeZone)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.timeZone)
+	tours, err := s.store.GetUpcomingTours(r.Context(), from, from.AddDate(0, 0, guideDays), maxRiders)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetUpcomingTours: %v", err)}
+	}
+	data := &AdminPlannerData{Page: staffPage(r), Warnings: warnings}
+	for _, t := range tours {
+		if t.Cancelled {
+			continue
+		}
+		pending, err := s.store.GetPendingRiders(r.Context(), t.ID, now.Add(-pendingWindow))
+		if err != nil {
+			s.log.Printf("GetPendingRiders: %v", err)
+			warnings[WarningGetPendingRiders] = true
+		}
+		teams, err := s.store.GetTeams(r.Context(), t.ID)
+		if err != nil {
+			s.log.Printf("GetTeams: %v", err)
+			warnings[WarningGetTeams] = true
+		}
+		data.Plans = append(data.Plans, s.planTeams(t, pending, len(teams)))
+	}
+	return data, warnings, nil
+}
+
+func (s *Server) HandleAdminPlanner(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	data, warnings, e := s.adminPlanner(r)
+	if e != nil {
+		s.handleAdminError(w, e)
+		return e.Code, warnings, e.Message
+	}
+	short := 0
+	for _, p := range data.Plans {
+		if p.NeedsTeam {
+			short++
+		}
+	}
+	summary = fmt.Sprintf("tours:%d short:%d", len(data.Plans), short)
+	tmpl, err := s.templates.Get("admin_planner.html")
+	if err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error parsing admin planner template"
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error executing admin planner template"
+	}
+	return http.StatusOK, warnings, summary
+}
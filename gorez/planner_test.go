@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTeamRatios(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    *teamRatios
+		wantErr bool
+	}{
+		{"", &teamRatios{defaultRidersPerTeam, map[string]int{}}, false},
+		{"12", &teamRatios{12, map[string]int{}}, false},
+		{"10,CPN=8,BKN=12", &teamRatios{10, map[string]int{"CPN": 8, "BKN": 12}}, false},
+		{" CPN = 8 , , 6 ", &teamRatios{6, map[string]int{"CPN": 8}}, false},
+		{"CPN=8", &teamRatios{defaultRidersPerTeam, map[string]int{"CPN": 8}}, false},
+		{"0", nil, true},
+		{"CPN=-1", nil, true},
+		{"CPN=eight", nil, true},
+		{"CPN", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTeamRatios(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTeamRatios(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTeamRatios(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestTeamsNeeded(t *testing.T) {
+	ratios := &teamRatios{10, map[string]int{"CPN": 8}}
+	tests := []struct {
+		code   string
+		riders int
+		want   int
+	}{
+		{"BKN", 0, 0},
+		{"BKN", -3, 0},
+		{"BKN", 1, 1},
+		{"BKN", 10, 1},
+		{"BKN", 11, 2},
+		{"CPN", 8, 1},
+		{"CPN", 9, 2},
+		{"CPN", 17, 3},
+	}
+	for _, tt := range tests {
+		if got := ratios.teamsNeeded(tt.code, tt.riders); got != tt.want {
+			t.Errorf("teamsNeeded(%q, %d) = %d, want %d", tt.code, tt.riders, got, tt.want)
+		}
+	}
+}
+
+func TestPlanTeams(t *testing.T) {
+	s := &Server{teamRatios: &teamRatios{10, map[string]int{"CPN": 8}}}
+	tests := []struct {
+		code                    string
+		riders, pending, assign int
+		wantNeeded, wantLimit   int
+		wantNeedsTeam           bool
+	}{
+		{"BKN", 0, 0, 0, 0, 0, false},
+		{"BKN", 10, 0, 1, 1, 10, false},
+		{"BKN", 8, 3, 1, 2, 10, true}, // pending riders count
+		{"BKN", 12, 0, 3, 2, 30, false},
+		{"CPN", 9, 0, 1, 2, 8, true},
+	}
+	for _, tt := range tests {
+		tourDetail := &TourDetail{Tour: Tour{Code: tt.code}, TotalRiders: tt.riders}
+		p := s.planTeams(tourDetail, tt.pending, tt.assign)
+		if p.Needed != tt.wantNeeded || p.NeedsTeam != tt.wantNeedsTeam || p.RidersLimit != tt.wantLimit {
+			t.Errorf("planTeams(%s, %d riders, %d pending, %d assigned) = needed %d, needs team %v, limit %d; want %d, %v, %d",
+				tt.code, tt.riders, tt.pending, tt.assign, p.Needed, p.NeedsTeam, p.RidersLimit,
+				tt.wantNeeded, tt.wantNeedsTeam, tt.wantLimit)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+const (
+	// orderChargeSlack allows for a charge being made a little after
+	// its order was placed, so that orders just before the window
+	// still match.
+	orderChargeSlack = time.Hour
+
+	// Charges younger than this may belong to a checkout that hasn't
+	// recorded its payment yet, so they're left for the next run.
+	minChargeAge = 10 * time.Minute
+)
+
+// ReconcileReport is the outcome of matching charges to orders.
+type ReconcileReport struct {
+	Since   time.Time
+	Charges int
+	Orders  int
+
+	// Fixed lists charges whose order wasn't marked completed, e.g.
+	// because UpdateOrderPaymentRecorded failed.  Unless the run was
+	// a dry run, the payment is now recorded.
+	Fixed []*ChargeProblem
+	// Orphaned lists charges with no order to match, or for an order
+	// that already has a different charge recorded.
+	Orphaned []*ChargeProblem
+	// Mismatched lists charges whose amount differs from the order's.
+	Mismatched []*ChargeProblem
+	// Unpaid lists completed orders with no matching charge.
+	Unpaid []*WebOrder
+
+	Errors []string
+}
+
+// ChargeProblem is a charge that needed attention.  Order is nil if
+// there's no matching order.
+type ChargeProblem struct {
+	Charge *Charge
+	Order  *WebOrder
+	Note   string
+}
+
+func (cp *ChargeProblem) String() string {
+	s := fmt.Sprintf("charge %s ($%d.%02d, %s)", cp.Charge.ID, cp.Charge.Amount/100, cp.Charge.Amount%100, cp.Charge.Created.UTC().Format("2006-01-02 15:04 MST"))
+	if cp.Order != nil {
+		s += fmt.Sprintf(" order %d tour %d", cp.Order.ID, cp.Order.TourID)
+	} else if cp.Charge.OrderID != 0 {
+		s += fmt.Sprintf(" order %d (not found)", cp.Charge.OrderID)
+	}
+	if cp.Note != "" {
+		s += ": " + cp.Note
+	}
+	return s
+}
+
+// OK reports whether there was nothing to fix or report.
+func (r *ReconcileReport) OK() bool {
+	return len(r.Fixed) == 0 && len(r.Orphaned) == 0 && len(r.Mismatched) == 0 && len(r.Unpaid) == 0 && len(r.Errors) == 0
+}
+
+// Write prints the report for staff.
+func (r *ReconcileReport) Write(w io.Writer) {
+	fmt.Fprintf(w, "Reconciled %d charges against %d orders since %s.\n", r.Charges, r.Orders, r.Since.UTC().Format("2006-01-02 15:04 MST"))
+	section := func(title string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s:\n", title)
+		for _, line := range lines {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	problems := func(cps []*ChargeProblem) []string {
+		var lines []string
+		for _, cp := range cps {
+			lines = append(lines, cp.String())
+		}
+		return lines
+	}
+	var unpaid []string
+	for _, o := range r.Unpaid {
+		unpaid = append(unpaid, fmt.Sprintf("order %d tour %d placed %s", o.ID, o.TourID, o.Placed.Format("2006-01-02 15:04 MST")))
+	}
+	section("Payments recorded for uncompleted orders", problems(r.Fixed))
+	section("Orphaned charges", problems(r.Orphaned))
+	section("Amount mismatches", problems(r.Mismatched))
+	section("Completed orders without a charge", unpaid)
+	section("Errors", r.Errors)
+}
+
+// reconcile matches the charges made since the given time to orders.
+// Unless dryRun is set, charges for orders that weren't marked
+// completed are recorded, which completes the orders.
+func (s *Server) reconcile(ctx context.Context, since time.Time, dryRun bool) (*ReconcileReport, error) {
+	settled := time.Now().Add(-minChargeAge)
+	charges, err := s.payments.ListCharges(ctx, since)
+	if err != nil {
+		return nil, fmt.Errorf("ListCharges: %v", err)
+	}
+	orders, err := s.store.GetWebOrders(ctx, since.Add(-orderChargeSlack))
+	if err != nil {
+		return nil, fmt.Errorf("GetWebOrders: %v", err)
+	}
+	report := &ReconcileReport{Since: since, Charges: len(charges), Orders: len(orders)}
+	byID := make(map[int32]*WebOrder)
+	for _, o := range orders {
+		byID[o.ID] = o
+	}
+	matched := make(map[int32]bool)
+	for _, ch := range charges {
+		if ch.Created.After(settled) {
+			matched[ch.OrderID] = true
+			continue
+		}
+		o := byID[ch.OrderID]
+		if o == nil {
+			note := "no OrderNum in metadata"
+			// The order may be older than the window.
+			if ch.OrderID != 0 {
+				note = ""
+				if _, ok, err := s.store.GetOrder(ctx, ch.OrderID); err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("GetOrder(%d): %v", ch.OrderID, err))
+					continue
+				} else if ok {
+					continue
+				}
+			}
+			report.Orphaned = append(report.Orphaned, &ChargeProblem{Charge: ch, Note: note})
+			continue
+		}
+		matched[o.ID] = true
+		switch {
+		case o.ChargeID == ch.ID:
+		case o.ChargeID != "":
+			report.Orphaned = append(report.Orphaned, &ChargeProblem{Charge: ch, Order: o, Note: "order already has charge " + o.ChargeID})
+			continue
+		case ch.Refunded:
+			// Refunded before anyone noticed; leave the order alone.
+			continue
+		default:
+			cp := &ChargeProblem{Charge: ch, Order: o}
+			if dryRun {
+				cp.Note = "dry run"
+			} else if err := s.store.UpdateOrderPaymentRecorded(ctx, o.ID, ch.ID, ch.Amount); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("UpdateOrderPaymentRecorded(%d): %v", o.ID, err))
+				continue
+			} else {
+				o.Completed, o.ChargeID = true, ch.ID
+			}
+			report.Fixed = append(report.Fixed, cp)
+		}
+		if ch.Amount/100 != o.Total/100 {
+			report.Mismatched = append(report.Mismatched, &ChargeProblem{Charge: ch, Order: o, Note: fmt.Sprintf("order total $%d", o.Total/100)})
+		}
+	}
+	for _, o := range orders {
+		// Orders placed before the window may have been charged before it.
+		if o.Completed && !matched[o.ID] && !o.Placed.Before(since) && o.Placed.Before(settled) {
+			report.Unpaid = append(report.Unpaid, o)
+		}
+	}
+	return report, nil
+}
+
+// runReconcile implements the reconcile subcommand and returns the
+// exit status: 0 if all is well, 1 if there were problems, 2 if the
+// reconciliation couldn't run.
+func runReconcile(s *Server, cfg *Config, args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	since := flags.Duration("since", cfg.ReconcileLookback, "how far back to look for charges")
+	dryRun := flags.Bool("dry_run", false, "report uncompleted orders without recording their payments")
+	flags.Parse(args)
+	report, err := s.reconcile(context.Background(), time.Now().Add(-*since), *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	report.Write(os.Stdout)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// Reconciler periodically reconciles recent charges and emails the
+// office about anything new it finds.
+type Reconciler struct {
+	server   *Server
+	interval time.Duration
+	lookback time.Duration
+	reported map[string]bool // problems already emailed
+}
+
+func NewReconciler(server *Server, interval, lookback time.Duration) *Reconciler {
+	return &Reconciler{
+		server:   server,
+		interval: interval,
+		lookback: lookback,
+		reported: make(map[string]bool),
+	}
+}
+
+// Run reconciles every interval until ctx is done.
+func (rc *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+	for {
+		// A run in progress finishes; it's bounded by the timeouts.
+		rc.runOnce(context.WithoutCancel(ctx), time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rc *Reconciler) runOnce(ctx context.Context, now time.Time) {
+	s := rc.server
+	report, err := s.reconcile(ctx, now.Add(-rc.lookback), false)
+	if err != nil {
+		s.log.Printf("Error reconciling payments: %v", err)
+		return
+	}
+	if report.OK() || !rc.anyNew(report) {
+		return
+	}
+	var body strings.Builder
+	report.Write(&body)
+	s.log.Printf("Reconciliation found problems: %d fixed, %d orphaned, %d mismatched, %d unpaid, %d errors",
+		len(report.Fixed), len(report.Orphaned), len(report.Mismatched), len(report.Unpaid), len(report.Errors))
+	from := mail.NewEmail("Bike the Big Apple reservations", "reservations@bikethebigapple.com")
+	to := mail.NewEmail("Bike the Big Apple reservations", "reservations@bikethebigapple.com")
+	if err := s.sendEmail(ctx, from, to, nil /*bcc*/, "Payment reconciliation", body.String()); err != nil {
+		s.log.Printf("Error emailing reconciliation report: %v", err)
+	}
+}
+
+// anyNew reports whether the report has problems that haven't been
+// emailed before, and remembers them.  Fixes are always new.
+func (rc *Reconciler) anyNew(report *ReconcileReport) bool {
+	found := len(report.Fixed) > 0 || len(report.Errors) > 0
+	for _, cp := range report.Orphaned {
+		found = rc.remember("orphaned:"+cp.Charge.ID) || found
+	}
+	for _, cp := range report.Mismatched {
+		found = rc.remember("mismatched:"+cp.Charge.ID) || found
+	}
+	for _, o := range report.Unpaid {
+		found = rc.remember(fmt.Sprintf("unpaid:%d", o.ID)) || found
+	}
+	return found
+}
+
+func (rc *Reconciler) remember(key string) bool {
+	if rc.reported[key] {
+		return false
+	}
+	rc.reported[key] = true
+	return true
+}
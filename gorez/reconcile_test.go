@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reconcileStore implements the Store methods reconcile uses.  Calling
+// any other method panics on the nil embedded Store.
+type reconcileStore struct {
+	Store
+	orders   []*WebOrder
+	older    map[int32]bool // orders placed before the window
+	recorded map[int32]string
+	failIDs  map[int32]bool
+}
+
+func (s *reconcileStore) GetWebOrders(ctx context.Context, since time.Time) ([]*WebOrder, error) {
+	return s.orders, nil
+}
+
+func (s *reconcileStore) GetOrder(ctx context.Context, orderID int32) (*Order, bool, error) {
+	return nil, s.older[orderID], nil
+}
+
+func (s *reconcileStore) UpdateOrderPaymentRecorded(ctx context.Context, orderID int32, chargeID string, amount int64) error {
+	if s.failIDs[orderID] {
+		return errors.New("deadlock")
+	}
+	s.recorded[orderID] = chargeID
+	return nil
+}
+
+// reconcilePayments implements ListCharges.
+type reconcilePayments struct {
+	Payments
+	charges []*Charge
+}
+
+func (p *reconcilePayments) ListCharges(ctx context.Context, since time.Time) ([]*Charge, error) {
+	return p.charges, nil
+}
+
+func chargeIDs(cps []*ChargeProblem) []string {
+	var ids []string
+	for _, cp := range cps {
+		ids = append(ids, cp.Charge.ID)
+	}
+	return ids
+}
+
+func orderIDs(orders []*WebOrder) []int32 {
+	var ids []int32
+	for _, o := range orders {
+		ids = append(ids, o.ID)
+	}
+	return ids
+}
+
+func newReconcileServer() (*Server, *reconcileStore, time.Time) {
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour)
+	store := &reconcileStore{
+		orders: []*WebOrder{
+			{ID: 1, Completed: true, Total: 4500, ChargeID: "ch_ok", Placed: hourAgo},
+			{ID: 2, Completed: false, Total: 4500, Placed: hourAgo},                   // payment not recorded
+			{ID: 3, Completed: true, Total: 9000, ChargeID: "ch_3a", Placed: hourAgo}, // charged twice
+			{ID: 4, Completed: true, Total: 9000, ChargeID: "ch_cheap", Placed: hourAgo},
+			{ID: 5, Completed: true, Total: 4500, ChargeID: "ch_gone", Placed: hourAgo}, // no charge
+			{ID: 6, Completed: false, Total: 4500, Placed: hourAgo},                     // refunded charge
+			{ID: 7, Completed: false, Total: 4500, Placed: hourAgo},                     // recording fails
+			{ID: 8, Completed: true, Total: 4500, ChargeID: "ch_new", Placed: now.Add(-time.Minute)},
+			{ID: 9, Completed: true, Total: 4500, ChargeID: "ch_early", Placed: now.Add(-3 * time.Hour)},
+		},
+		older:    map[int32]bool{100: true},
+		recorded: make(map[int32]string),
+		failIDs:  map[int32]bool{7: true},
+	}
+	payments := &reconcilePayments{charges: []*Charge{
+		{ID: "ch_ok", OrderID: 1, Amount: 4500, Created: hourAgo},
+		{ID: "ch_2", OrderID: 2, Amount: 4500, Created: hourAgo},
+		{ID: "ch_3a", OrderID: 3, Amount: 9000, Created: hourAgo},
+		{ID: "ch_3b", OrderID: 3, Amount: 9000, Created: hourAgo},
+		{ID: "ch_cheap", OrderID: 4, Amount: 4500, Created: hourAgo},
+		{ID: "ch_6", OrderID: 6, Amount: 4500, Created: hourAgo, Refunded: true},
+		{ID: "ch_7", OrderID: 7, Amount: 4500, Created: hourAgo},
+		{ID: "ch_new", OrderID: 8, Amount: 4500, Created: now.Add(-time.Minute)}, // not settled
+		{ID: "ch_old", OrderID: 100, Amount: 4500, Created: hourAgo},             // order before the window
+		{ID: "ch_lost", OrderID: 200, Amount: 4500, Created: hourAgo},
+		{ID: "ch_anon", Amount: 4500, Created: hourAgo},
+	}}
+	return &Server{store: store, payments: payments}, store, now.Add(-2 * time.Hour)
+}
+
+func TestReconcile(t *testing.T) {
+	s, store, since := newReconcileServer()
+	report, err := s.reconcile(context.Background(), since, false)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if report.Charges != 11 || report.Orders != 9 {
+		t.Errorf("reconcile counted %d charges, %d orders; want 11, 9", report.Charges, report.Orders)
+	}
+	if got, want := chargeIDs(report.Fixed), []string{"ch_2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fixed = %v, want %v", got, want)
+	}
+	if got, want := chargeIDs(report.Orphaned), []string{"ch_3b", "ch_lost", "ch_anon"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Orphaned = %v, want %v", got, want)
+	}
+	if got, want := chargeIDs(report.Mismatched), []string{"ch_cheap"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Mismatched = %v, want %v", got, want)
+	}
+	if got, want := orderIDs(report.Unpaid), []int32{5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unpaid = %v, want %v", got, want)
+	}
+	if len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "UpdateOrderPaymentRecorded(7)") {
+		t.Errorf("Errors = %v, want the failure recording order 7", report.Errors)
+	}
+	if want := map[int32]string{2: "ch_2"}; !reflect.DeepEqual(store.recorded, want) {
+		t.Errorf("recorded payments %v, want %v", store.recorded, want)
+	}
+	if report.OK() {
+		t.Error("OK() = true, want false")
+	}
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	s, store, since := newReconcileServer()
+	report, err := s.reconcile(context.Background(), since, true)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if got, want := chargeIDs(report.Fixed), []string{"ch_2", "ch_7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fixed = %v, want %v", got, want)
+	}
+	if len(store.recorded) != 0 {
+		t.Errorf("dry run recorded payments %v", store.recorded)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("Errors = %v, want none", report.Errors)
+	}
+}
+
+func TestReconcilerAnyNew(t *testing.T) {
+	rc := NewReconciler(nil, time.Hour, time.Hour)
+	report := &ReconcileReport{
+		Orphaned: []*ChargeProblem{{Charge: &Charge{ID: "ch_1"}}},
+		Unpaid:   []*WebOrder{{ID: 5}},
+	}
+	if !rc.anyNew(report) {
+		t.Error("anyNew(first report) = false, want true")
+	}
+	if rc.anyNew(report) {
+		t.Error("anyNew(same report) = true, want false")
+	}
+	report.Mismatched = []*ChargeProblem{{Charge: &Charge{ID: "ch_1"}}}
+	if !rc.anyNew(report) {
+		t.Error("anyNew(new mismatch) = false, want true")
+	}
+	if !rc.anyNew(&ReconcileReport{Fixed: []*ChargeProblem{{Charge: &Charge{ID: "ch_2"}}}}) {
+		t.Error("anyNew(fix) = false, want true")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+const (
+	// A claimed notice that hasn't been marked sent within this time
+	// is assumed to belong to a crashed instance and is retried.
+	noticeClaimTimeout = 10 * time.Minute
+
+	// Tours don't record how long they last, so the follow-up delay
+	// is counted from this long after the start.
+	assumedTourLength = 4 * time.Hour
+
+	// Follow-ups aren't sent for tours further in the past than this,
+	// e.g. when the feature is first turned on.
+	followupWindow = 3 * 24 * time.Hour
+
+	NoticeReminder     = "reminder"
+	NoticeFollowup     = "followup"
+	NoticeCancellation = "cancellation"
+)
+
+// Scheduler periodically sends reminders about upcoming tours and
+// follow-ups after past ones.  Several instances may run against the
+// same database: each notice is claimed in OrderNotices before it is
+// sent, so only one instance sends it.
+type Scheduler struct {
+	server        *Server
+	interval      time.Duration
+	reminderLead  time.Duration
+	followupDelay time.Duration
+	instance      string
+}
+
+func NewScheduler(server *Server, interval, reminderLead, followupDelay time.Duration) *Scheduler {
+	return &Scheduler{
+		server:        server,
+		interval:      interval,
+		reminderLead:  reminderLead,
+		followupDelay: followupDelay,
+		instance:      instanceName(),
+	}
+}
+
+// instanceName identifies this server process when claiming notices.
+func instanceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// Run sends notices every interval until ctx is done.
+func (sc *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+	for {
+		sc.runOnce(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOnce sends the notices due at now.  If ctx is cancelled it stops
+// between notices; a notice already claimed is always finished.
+func (sc *Scheduler) runOnce(ctx context.Context, now time.Time) {
+	if sc.reminderLead > 0 {
+		sc.sendReminders(ctx, now)
+	}
+	if sc.followupDelay > 0 {
+		sc.sendFollowups(ctx, now)
+	}
+}
+
+// claim reports whether this instance should send a notice.
+func (sc *Scheduler) claim(ctx context.Context, order *Order, kind string, now time.Time) bool {
+	s := sc.server
+	claimed, err := s.store.ClaimNotice(ctx, order.ID, kind, sc.instance, now, now.Add(-noticeClaimTimeout))
+	if err != nil {
+		s.log.Printf("ClaimNotice(%d, %s): %v", order.ID, kind, err)
+		return false
+	}
+	return claimed // false if another instance got there first
+}
+
+// tourDetail looks up an order's tour, caching the result in tours.
+func (sc *Scheduler) tourDetail(ctx context.Context, tours map[int32]*TourDetail, tourID int32) (*TourDetail, bool) {
+	if tourDetail, ok := tours[tourID]; ok {
+		return tourDetail, true
+	}
+	tourDetail, ok, err := sc.server.store.GetTourDetailByID(ctx, tourID, maxRiders)
+	if err != nil || !ok {
+		sc.server.log.Printf("GetTourDetailByID(%d): ok=%t err=%v", tourID, ok, err)
+		return nil, false
+	}
+	tours[tourID] = tourDetail
+	return tourDetail, true
+}
+
+// markSent records that a notice went out.
+func (sc *Scheduler) markSent(ctx context.Context, order *Order, kind string) {
+	if err := sc.server.store.UpdateNoticeSent(ctx, order.ID, kind, time.Now()); err != nil {
+		sc.server.log.Printf("UpdateNoticeSent(%d, %s): %v", order.ID, kind, err)
+	}
+}
+
+// ReminderData is the data passed to the reminder email template.
+type ReminderData struct {
+	Order           *Order
+	TourDetail      *TourDetail
+	WeatherAdvisory string // empty if none
+	WaiverLinks     []*WaiverLink
+}
+
+// sendReminders emails every order on a tour starting within
+// reminderLead, except those placed so late that the confirmation
+// serves as the reminder.
+func (sc *Scheduler) sendReminders(ctx context.Context, now time.Time) {
+	s := sc.server
+	work := context.WithoutCancel(ctx)
+	orders, err := s.store.GetNoticeOrders(work, NoticeReminder, now, now.Add(sc.reminderLead), sc.reminderLead, now.Add(-noticeClaimTimeout))
+	if err != nil {
+		s.log.Printf("GetNoticeOrders(%s): %v", NoticeReminder, err)
+		return
+	}
+	advisory := sc.weatherAdvisory()
+	tours := make(map[int32]*TourDetail)
+	for _, order := range orders {
+		if ctx.Err() != nil {
+			return
+		}
+		if order.Email == "" {
+			continue
+		}
+		tourDetail, ok := sc.tourDetail(work, tours, order.TourID)
+		if !ok || !sc.claim(work, order, NoticeReminder, now) {
+			continue
+		}
+		data := &ReminderData{
+			Order:           order,
+			TourDetail:      tourDetail,
+			WeatherAdvisory: advisory,
+			WaiverLinks:     s.waiverLinks(order.ID, order.NumRiders),
+		}
+		if err := s.emailReminder(work, data); err != nil {
+			// The claim times out, so the reminder is retried later.
+			s.log.Printf("Error emailing reminder for order %d: %v", order.ID, err)
+			continue
+		}
+		sc.markSent(work, order, NoticeReminder)
+		if order.SMSNumber != "" && s.sms != nil {
+			if err := s.sms.SendSMS(work, order.SMSNumber, reminderSMS(data)); err != nil {
+				s.log.Printf("Error texting reminder for order %d: %v", order.ID, err)
+			}
+		}
+	}
+}
+
+// FollowupData is the data passed to the follow-up email template.
+type FollowupData struct {
+	Order       *Order
+	TourDetail  *TourDetail
+	FeedbackURL string // empty if links can't be signed
+}
+
+// sendFollowups thanks riders once followupDelay has passed since
+// their tour ended, and asks for a review and feedback.
+func (sc *Scheduler) sendFollowups(ctx context.Context, now time.Time) {
+	s := sc.server
+	work := context.WithoutCancel(ctx)
+	until := now.Add(-sc.followupDelay - assumedTourLength)
+	orders, err := s.store.GetNoticeOrders(work, NoticeFollowup, until.Add(-followupWindow), until, 0, now.Add(-noticeClaimTimeout))
+	if err != nil {
+		s.log.Printf("GetNoticeOrders(%s): %v", NoticeFollowup, err)
+		return
+	}
+	tours := make(map[int32]*TourDetail)
+	for _, order := range orders {
+		if ctx.Err() != nil {
+			return
+		}
+		if order.Email == "" {
+			continue
+		}
+		tourDetail, ok := sc.tourDetail(work, tours, order.TourID)
+		if !ok || !sc.claim(work, order, NoticeFollowup, now) {
+			continue
+		}
+		data := &FollowupData{
+			Order:       order,
+			TourDetail:  tourDetail,
+			FeedbackURL: s.feedbackURL(order.ID),
+		}
+		if err := s.emailFollowup(work, data); err != nil {
+			s.log.Printf("Error emailing follow-up for order %d: %v", order.ID, err)
+			continue
+		}
+		sc.markSent(work, order, NoticeFollowup)
+	}
+}
+
+// weatherAdvisory returns the contents of weather_advisory.txt in the
+// email templates directory, which the office edits as forecasts
+// change.  A missing file means there's no advisory.
+func (sc *Scheduler) weatherAdvisory() string {
+	b, err := os.ReadFile(path.Join(sc.server.emailTemplatesDir, "weather_advisory.txt"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			sc.server.log.Printf("Error reading weather advisory: %v", err)
+		}
+		return ""
+	}
+	return string(bytes.TrimSpace(b))
+}
+
+func (s *Server) emailReminder(ctx context.Context, data *ReminderData) error {
+	tmpl, err := s.emailTemplates.Get("reminder.txt")
+	if err != nil {
+		return fmt.Errorf("load reminder email template: %v", err)
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return fmt.Errorf("execute reminder email template: %v", err)
+	}
+	from := mail.NewEmail("Bike the Big Apple reservations", "reservations@bikethebigapple.com")
+	to := mail.NewEmail(data.Order.Name, data.Order.Email)
+	subject := fmt.Sprintf("%s Tour %s Bike Tour Reminder", data.TourDetail.Time.Format("January 2"), data.TourDetail.Code)
+	if err := s.sendEmail(ctx, from, to, nil /*bcc*/, subject, body.String()); err != nil {
+		return fmt.Errorf("send reminder email: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) emailFollowup(ctx context.Context, data *FollowupData) error {
+	tmpl, err := s.emailTemplates.Get("followup.txt")
+	if err != nil {
+		return fmt.Errorf("load follow-up email template: %v", err)
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return fmt.Errorf("execute follow-up email template: %v", err)
+	}
+	from := mail.NewEmail("Bike the Big Apple", "explore@bikethebigapple.com")
+	to := mail.NewEmail(data.Order.Name, data.Order.Email)
+	subject := fmt.Sprintf("Thank you for riding %s with Bike the Big Apple", data.TourDetail.LongName)
+	if err := s.sendEmail(ctx, from, to, nil /*bcc*/, subject, body.String()); err != nil {
+		return fmt.Errorf("send follow-up email: %v", err)
+	}
+	return nil
+}
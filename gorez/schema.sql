@@ -0,0 +1,93 @@
+-- Tables used by gorez in addition to the existing reservation
+-- schema (Master, MasterTourInfo, OrderMain, OrderItems, Guides).
+
+-- Contact details for guides and sweeps, keyed by the names used in
+-- Guides.GuideName and Guides.SweepName.
+CREATE TABLE IF NOT EXISTS GuideContacts (
+  Name VARCHAR(64) NOT NULL PRIMARY KEY,
+  Email VARCHAR(80),
+  Mobile VARCHAR(35)
+);
+
+-- Bike inventory.  Location matches Master.ConfCode, the meeting
+-- point the bikes are kept at; FrameSize is one of XS, S, M, L, XL.
+CREATE TABLE IF NOT EXISTS Bikes (
+  RecordNum INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  Location VARCHAR(32) NOT NULL,
+  FrameSize VARCHAR(4) NOT NULL,
+  Count INT NOT NULL DEFAULT 0,
+  KEY (Location)
+);
+
+-- One row per rider in an order.  OrderMain.Heights still holds the
+-- display string produced by heightsString.
+CREATE TABLE IF NOT EXISTS OrderRiders (
+  OrderNum INT NOT NULL,
+  RiderIndex INT NOT NULL,
+  Gender CHAR(1) NOT NULL,
+  HeightInches INT,
+  Name VARCHAR(64),
+  Age INT,
+  PRIMARY KEY (OrderNum, RiderIndex)
+);
+
+-- Booking-level contact details not held in OrderMain.
+CREATE TABLE IF NOT EXISTS OrderContacts (
+  OrderNum INT NOT NULL PRIMARY KEY,
+  EmergencyName VARCHAR(64),
+  EmergencyPhone VARCHAR(35),
+  SMSNumber VARCHAR(16) -- E.164, set only if the customer opted in to texts
+);
+
+-- Electronic liability waivers, one row per rider per waiver version.
+CREATE TABLE IF NOT EXISTS Waivers (
+  OrderNum INT NOT NULL,
+  RiderIndex INT NOT NULL,
+  SignedName VARCHAR(64) NOT NULL,
+  SignedAt DATETIME NOT NULL,
+  IP VARCHAR(45),
+  WaiverVersion VARCHAR(16) NOT NULL,
+  PRIMARY KEY (OrderNum, RiderIndex, WaiverVersion)
+);
+
+-- Scheduled emails per order.  A row is claimed by one server
+-- instance before sending and SentAt is set once the email is out.
+CREATE TABLE IF NOT EXISTS OrderNotices (
+  OrderNum INT NOT NULL,
+  Kind VARCHAR(16) NOT NULL,
+  ClaimedBy VARCHAR(128) NOT NULL,
+  ClaimedAt DATETIME NOT NULL,
+  SentAt DATETIME,
+  PRIMARY KEY (OrderNum, Kind)
+);
+
+-- Customer feedback collected after the tour, one row per order.
+CREATE TABLE IF NOT EXISTS Feedback (
+  OrderNum INT NOT NULL PRIMARY KEY,
+  TourID INT NOT NULL,
+  Rating TINYINT NOT NULL,
+  Comments TEXT,
+  CreatedAt DATETIME NOT NULL,
+  KEY (TourID),
+  KEY (CreatedAt)
+);
+
+-- Card charges, one per completed order, so that they can be refunded
+-- in bulk when a tour is cancelled.
+CREATE TABLE IF NOT EXISTS OrderPayments (
+  OrderNum INT NOT NULL PRIMARY KEY,
+  ChargeID VARCHAR(64) NOT NULL,
+  Amount INT NOT NULL, -- cents
+  RefundID VARCHAR(64),
+  RefundedAt DATETIME
+);
+
+-- Each tour's IANA time zone, e.g. America/New_York.  TourDateTime is
+-- the local clock time there; NULL means the -tour_time_zone default.
+-- MySQL has no ADD COLUMN IF NOT EXISTS, so check first.
+SET @stmt = (SELECT IF(COUNT(*) = 0, 'ALTER TABLE Master ADD COLUMN TimeZone VARCHAR(64)', 'DO 0')
+  FROM information_schema.COLUMNS
+  WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'Master' AND COLUMN_NAME = 'TimeZone');
+PREPARE stmt FROM @stmt;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
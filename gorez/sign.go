@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// sign returns a URL-safe signature of fields under the server's
+// signing key, for links we hand to customers.  The first field
+// should name the purpose (e.g. "waiver") so that a signature for one
+// kind of link can't be replayed on another.  sign returns "" if no
+// signing key is configured.
+func (s *Server) sign(fields ...string) string {
+	return hmacSign(s.signingKey, fields...)
+}
+
+// verify reports whether sig is the signature of fields.
+func (s *Server) verify(sig string, fields ...string) bool {
+	return hmacVerify(s.signingKey, sig, fields...)
+}
+
+// signForm is like sign but for values round-tripped through our own
+// forms, which must be signed even when links aren't.  It uses
+// formKey: the signing key, or in dev mode without one a key made at
+// startup.
+func (s *Server) signForm(fields ...string) string {
+	return hmacSign(s.formKey, fields...)
+}
+
+// verifyForm reports whether sig is the signForm signature of fields.
+func (s *Server) verifyForm(sig string, fields ...string) bool {
+	return hmacVerify(s.formKey, sig, fields...)
+}
+
+func hmacSign(key []byte, fields ...string) string {
+	if len(key) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(fields, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func hmacVerify(key []byte, sig string, fields ...string) bool {
+	expected := hmacSign(key, fields...)
+	return expected != "" && hmac.Equal([]byte(sig), []byte(expected))
+}
+
+// newFormKey returns a random key for signForm, for dev servers
+// without a signing key.  Forms it signs don't verify on other
+// instances or after a restart.
+func newFormKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
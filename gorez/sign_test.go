@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestHMACSign(t *testing.T) {
+	key := []byte("secret")
+	sig := hmacSign(key, "waiver", "123")
+	if sig == "" {
+		t.Fatal("hmacSign returned no signature")
+	}
+	if got := hmacSign(key, "waiver", "123"); got != sig {
+		t.Errorf("hmacSign isn't deterministic: %q, %q", sig, got)
+	}
+	tests := []struct {
+		name   string
+		key    []byte
+		sig    string
+		fields []string
+		want   bool
+	}{
+		{"valid", key, sig, []string{"waiver", "123"}, true},
+		{"other purpose", key, sig, []string{"review", "123"}, false},
+		{"other ID", key, sig, []string{"waiver", "124"}, false},
+		// Fields are separated, so they can't be shifted between each other.
+		{"fields joined", key, sig, []string{"waiver1", "23"}, false},
+		{"other key", []byte("other"), sig, []string{"waiver", "123"}, false},
+		{"empty signature", key, "", []string{"waiver", "123"}, false},
+		{"truncated", key, sig[:len(sig)-1], []string{"waiver", "123"}, false},
+	}
+	for _, tt := range tests {
+		if got := hmacVerify(tt.key, tt.sig, tt.fields...); got != tt.want {
+			t.Errorf("%s: hmacVerify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHMACSignNoKey(t *testing.T) {
+	if sig := hmacSign(nil, "waiver", "123"); sig != "" {
+		t.Errorf("hmacSign without a key = %q, want \"\"", sig)
+	}
+	// Without a key nothing verifies, not even an empty signature.
+	if hmacVerify(nil, "", "waiver", "123") {
+		t.Error("hmacVerify without a key = true, want false")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SMSSender sends text messages to E.164 numbers.
+type SMSSender interface {
+	SendSMS(ctx context.Context, to, body string) error
+}
+
+// HTTPSMSSender sends texts through a Twilio-style HTTP API: a form
+// POST of To, From and Body to apiURL with basic auth.  Pointing
+// apiURL at a local stand-in makes it easy to exercise without a
+// provider account.
+type HTTPSMSSender struct {
+	apiURL   string
+	user     string
+	password string
+	from     string
+	client   *http.Client
+}
+
+func NewHTTPSMSSender(apiURL, user, password, from string) *HTTPSMSSender {
+	return &HTTPSMSSender{
+		apiURL:   apiURL,
+		user:     user,
+		password: password,
+		from:     from,
+		client:   &http.Client{Timeout: smsTimeout},
+	}
+}
+
+func (h *HTTPSMSSender) SendSMS(ctx context.Context, to, body string) error {
+	form := url.Values{
+		"To":   {to},
+		"From": {h.from},
+		"Body": {body},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.apiURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if h.user != "" {
+		req.SetBasicAuth(h.user, h.password)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("SMS provider returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// normalizePhone converts a phone number as typed by a customer to
+// E.164 form, e.g. "(212) 555-0100" -> "+12125550100".  Numbers
+// without a country code are assumed to be North American.
+func normalizePhone(s string) (string, bool) {
+	var digits strings.Builder
+	plus := false
+	for i, r := range strings.TrimSpace(s) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			plus = true
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')' || r == '/':
+			// separators
+		default:
+			return "", false
+		}
+	}
+	d := digits.String()
+	switch {
+	case plus:
+	case strings.HasPrefix(d, "00"): // international dialling prefix
+		d = d[2:]
+	case strings.HasPrefix(d, "011"): // same, from North America
+		d = d[3:]
+	case len(d) == 10:
+		d = "1" + d
+	case len(d) == 11 && d[0] == '1':
+	default:
+		return "", false
+	}
+	if len(d) < 8 || len(d) > 15 || d[0] == '0' {
+		return "", false
+	}
+	return "+" + d, true
+}
+
+// bookingSMS is the text sent to confirm a booking.
+func bookingSMS(data *ConfirmationData) string {
+	return fmt.Sprintf("Bike the Big Apple: you're booked on %s, %s, for %d. Details have been emailed to %s.",
+		data.TourDetail.LongName, data.TourDetail.Time.Format("Mon Jan 2 at 3:04pm"), data.NumRiders, data.Email)
+}
+
+// reminderSMS is the text sent along with the reminder email.
+func reminderSMS(data *ReminderData) string {
+	return fmt.Sprintf("Bike the Big Apple: see you %s for %s! Check your email for meeting point details.",
+		data.TourDetail.Time.Format("Mon Jan 2 at 3:04pm"), data.TourDetail.LongName)
+}
+
+// cancellationSMS is the text sent along with the cancellation email.
+func cancellationSMS(data *CancellationData) string {
+	next := "We've refunded you in full."
+	switch {
+	case data.RefundByHand:
+		next = "Our office will refund you."
+	case !data.Refunded:
+		next = "Rebook at " + data.RescheduleURL
+	}
+	return fmt.Sprintf("Bike the Big Apple: we're sorry, %s on %s is cancelled. %s Details have been emailed to you.",
+		data.TourDetail.LongName, data.TourDetail.Time.Format("Mon Jan 2 at 3:04pm"), next)
+}
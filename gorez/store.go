@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,7 +15,7 @@ import (
 type Tour struct {
 	ID            int32
 	Code          string
-	Time          time.Time
+	Time          time.Time // in the tour's time zone
 	ConfCode      string
 	AutoConfirm   bool
 	Full          bool
@@ -30,8 +33,25 @@ type TourDetail struct {
 }
 
 type Rider struct {
-	Gender string
-	Height int
+	Gender string `json:"gender"`
+	Height int    `json:"height_inches"`  // zero or negative if unknown
+	Name   string `json:"name,omitempty"` // optional
+	Age    int    `json:"age,omitempty"`  // optional; zero if unknown
+}
+
+// Display returns the rider's details for staff, e.g. "Ann, 12, F5'4".
+func (r Rider) Display() string {
+	var parts []string
+	if r.Name != "" {
+		parts = append(parts, r.Name)
+	}
+	if r.Age > 0 {
+		parts = append(parts, strconv.Itoa(r.Age))
+	}
+	if r.Gender != "" {
+		parts = append(parts, heightsString([]Rider{r}))
+	}
+	return strings.Join(parts, ", ")
 }
 
 type Team struct {
@@ -39,23 +59,172 @@ type Team struct {
 	Sweep string
 }
 
+// GuideTour is an upcoming tour as seen by one of its guides or
+// sweeps.  Teams and Roster are filled in by the caller.
+type GuideTour struct {
+	Tour
+	LongName string
+	Teams    []*Team
+	Roster   []*RosterEntry
+}
+
+// RosterEntry is one completed order on a tour.
+type RosterEntry struct {
+	OrderID   int32
+	Name      string
+	NumRiders int
+	Heights   string
+	Riders    []Rider // empty for orders placed before riders were stored individually
+	Mobile    string
+	Hotel     string
+	Misc      string
+	Emergency EmergencyContact
+	Waivers   []*WaiverSignature
+}
+
+// Order is a booking as read back from the database.
+type Order struct {
+	ID        int32
+	TourID    int32
+	NumRiders int
+	Name      string
+	Email     string
+	Mobile    string
+	SMSNumber string // E.164; empty unless opted in to texts
+	Completed bool
+	Riders    []Rider
+	TourTime  time.Time // in the tour's time zone; zero from GetOrder
+	Placed    time.Time // zero from GetOrder
+}
+
+// WaiverSignature records one rider agreeing to a version of the
+// liability waiver.
+type WaiverSignature struct {
+	OrderID    int32
+	RiderIndex int
+	SignedName string
+	SignedAt   time.Time
+	IP         string
+	Version    string
+}
+
+// EmergencyContact is the person to call if something happens to
+// someone in the party.  Both fields are optional.
+type EmergencyContact struct {
+	Name  string
+	Phone string
+}
+
+// OrderContacts holds the booking-level contact details stored
+// alongside OrderMain.
+type OrderContacts struct {
+	Emergency EmergencyContact
+	SMSNumber string // E.164; empty unless the customer opted in to texts
+}
+
+// WebOrder is an order placed through gorez, with the charge recorded
+// for it, for reconciling against the payment provider.
+type WebOrder struct {
+	ID        int32
+	TourID    int32
+	Completed bool
+	Total     int64  // cents, but OrderItems.Price only keeps whole dollars
+	ChargeID  string // empty if no charge was recorded
+	Placed    time.Time
+}
+
+// Payment is the card charge for an order.
+type Payment struct {
+	OrderID    int32
+	ChargeID   string
+	Amount     int64     // cents
+	RefundID   string    // empty unless refunded
+	RefundedAt time.Time // zero unless refunded
+}
+
 type Store interface {
-	GetTourDetailByID(tourID int32, maxRiders int) (*TourDetail, bool, error)
-	GetTeams(tourID int32) ([]*Team, error)
-	CreateOrder(tourID int32, numRiders int, riders []Rider, total int64, name, email, mobile, hotel, misc string) (int32, error)
-	UpdateOrderPaymentRecorded(orderID int32) error
-	UpdateOrderConfirmationSent(orderID int32) error
+	Ping(ctx context.Context) error
+	GetTourDetailByID(ctx context.Context, tourID int32, maxRiders int) (*TourDetail, bool, error)
+	GetUpcomingTours(ctx context.Context, from, until time.Time, maxRiders int) ([]*TourDetail, error)
+	GetPendingRiders(ctx context.Context, tourID int32, since time.Time) (int, error)
+	GetTeams(ctx context.Context, tourID int32) ([]*Team, error)
+	GetTeamVersions(ctx context.Context, tourID int32) ([]int, error)
+	GetTeamsVersion(ctx context.Context, tourID int32, version int) ([]*Team, error)
+	CreateTeamsVersion(ctx context.Context, tourID int32, teams []*Team) (int, []*Team, error)
+	GetGuideEmails(ctx context.Context, names []string) (map[string]string, error)
+	IsGuide(ctx context.Context, name string) (bool, error)
+	GetGuideTours(ctx context.Context, guide string, from time.Time) ([]*GuideTour, error)
+	GetRoster(ctx context.Context, tourID int32) ([]*RosterEntry, error)
+	GetBikeStock(ctx context.Context, location string) (map[string]int, error)
+	GetBookedRiders(ctx context.Context, location string, t time.Time, excludeOrderID int32) ([]Rider, error)
+	GetOrderRiders(ctx context.Context, orderID int32) ([]Rider, error)
+	CreateOrder(ctx context.Context, tourID int32, numRiders int, riders []Rider, total int64, name, email, mobile, hotel, misc string, contacts OrderContacts) (int32, error)
+	GetOrder(ctx context.Context, orderID int32) (*Order, bool, error)
+	GetWebOrders(ctx context.Context, since time.Time) ([]*WebOrder, error)
+	UpdateOrderPaymentRecorded(ctx context.Context, orderID int32, chargeID string, amount int64) error
+	UpdateOrderConfirmationSent(ctx context.Context, orderID int32) error
+	GetTourOrders(ctx context.Context, tourID int32) ([]*Order, error)
+	GetTourPayments(ctx context.Context, tourID int32) (map[int32]*Payment, error)
+	UpdatePaymentRefunded(ctx context.Context, orderID int32, refundID string, refundedAt time.Time) error
+	UpdateTourCancelled(ctx context.Context, tourID int32) error
+	GetNoticeOrders(ctx context.Context, kind string, tourFrom, tourUntil time.Time, minNotice time.Duration, staleClaim time.Time) ([]*Order, error)
+	ClaimNotice(ctx context.Context, orderID int32, kind, instance string, now, staleClaim time.Time) (bool, error)
+	UpdateNoticeSent(ctx context.Context, orderID int32, kind string, sentAt time.Time) error
+	SaveFeedback(ctx context.Context, fb *Feedback) error
+	GetFeedback(ctx context.Context, since time.Time) ([]*Feedback, error)
+	CreateWaiverSignature(ctx context.Context, sig *WaiverSignature) (bool, error)
+	GetOrderWaivers(ctx context.Context, orderID int32) ([]*WaiverSignature, error)
+	GetTourWaivers(ctx context.Context, tourID int32) ([]*WaiverSignature, error)
 }
 
+// RemoteStore implements Store using MySQL.  Each method gives up
+// after dbTimeout, or sooner if its context is cancelled.
 type RemoteStore struct {
-	db *sql.DB
+	db    *sql.DB
+	zones *zoneCache
+}
+
+func (s *RemoteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
 }
 
-func (s *RemoteStore) GetTourDetailByID(tourID int32, maxRiders int) (*TourDetail, bool, error) {
+// tourDetailQuery selects the columns read by scanTourDetail.  Callers
+// append a WHERE clause.
+const tourDetailQuery = "" +
+	"SELECT Master.TourID, " +
+	"    Master.TourCode, " +
+	"    Master.TourDateTime, " +
+	"    Master.TimeZone, " +
+	"    Master.ConfCode, " +
+	"    Master.AutoConfirm <> 0, " +
+	"    Master.TourFull, " +
+	"    Master.Cancelled, " +
+	"    Master.RiderLimit, " +
+	"    Master.HeightsNeeded <> 0, " +
+	"    Master.Deleted, " +
+	"    MasterTourInfo.LongName, " +
+	"    MasterTourInfo.Price, " +
+	"    Riders.Count " +
+	"FROM Master " +
+	"LEFT JOIN MasterTourInfo ON Master.TourCode = MasterTourInfo.ShortCode " +
+	"LEFT JOIN (" +
+	"    SELECT TourID, SUM(Riders) AS Count " +
+	"    FROM OrderItems, OrderMain " +
+	"    WHERE OrderItems.OrderNum = OrderMain.OrderNum AND OrderMain.Completed <> 0 " +
+	"    GROUP BY TourID" +
+	") AS Riders ON Master.TourID = Riders.TourID "
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (s *RemoteStore) scanTourDetail(row scanner, maxRiders int) (*TourDetail, error) {
 	var (
 		id            int32
 		code          sql.NullString
 		time          mysql.NullTime
+		timeZone      sql.NullString
 		confCode      sql.NullString
 		autoConfirm   sql.NullBool
 		full          sql.NullBool
@@ -67,42 +236,15 @@ func (s *RemoteStore) GetTourDetailByID(tourID int32, maxRiders int) (*TourDetai
 		price         sql.NullFloat64
 		totalRiders   sql.NullInt64 // SUM() can return NULL
 	)
-	row := s.db.QueryRow(""+
-		"SELECT Master.TourID, "+
-		"    Master.TourCode, "+
-		"    Master.TourDateTime, "+
-		"    Master.ConfCode, "+
-		"    Master.AutoConfirm <> 0, "+
-		"    Master.TourFull, "+
-		"    Master.Cancelled, "+
-		"    Master.RiderLimit, "+
-		"    Master.HeightsNeeded <> 0, "+
-		"    Master.Deleted, "+
-		"    MasterTourInfo.LongName, "+
-		"    MasterTourInfo.Price, "+
-		"    Riders.Count "+
-		"FROM Master "+
-		"LEFT JOIN MasterTourInfo ON Master.TourCode = MasterTourInfo.ShortCode "+
-		"LEFT JOIN ("+
-		"    SELECT TourID, SUM(Riders) AS Count "+
-		"    FROM OrderItems, OrderMain "+
-		"    WHERE OrderItems.OrderNum = OrderMain.OrderNum AND OrderMain.Completed <> 0 "+
-		"    GROUP BY TourID"+
-		") AS Riders ON Master.TourID = Riders.TourID "+
-		"WHERE Master.TourID = ?",
-		tourID)
-	err := row.Scan(&id, &code, &time, &confCode, &autoConfirm, &full, &cancelled, &riderLimit, &heightsNeeded, &deleted, &longName, &price, &totalRiders)
+	err := row.Scan(&id, &code, &time, &timeZone, &confCode, &autoConfirm, &full, &cancelled, &riderLimit, &heightsNeeded, &deleted, &longName, &price, &totalRiders)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, false, nil
-		}
-		return nil, false, err
+		return nil, err
 	}
 	tourDetail := &TourDetail{
 		Tour: Tour{
 			ID:            id,
 			Code:          code.String,
-			Time:          time.Time,
+			Time:          tourTime(time.Time, s.zones.get(timeZone.String)),
 			ConfCode:      confCode.String,
 			AutoConfirm:   autoConfirm.Bool,
 			Full:          full.Bool,
@@ -119,11 +261,82 @@ func (s *RemoteStore) GetTourDetailByID(tourID int32, maxRiders int) (*TourDetai
 	} else {
 		tourDetail.NumSpotsRemaining = int(riderLimit.Int64) - int(totalRiders.Int64)
 	}
+	return tourDetail, nil
+}
+
+func (s *RemoteStore) GetTourDetailByID(ctx context.Context, tourID int32, maxRiders int) (*TourDetail, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	row := s.db.QueryRowContext(ctx, tourDetailQuery+"WHERE Master.TourID = ?", tourID)
+	tourDetail, err := s.scanTourDetail(row, maxRiders)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
 	return tourDetail, true, nil
 }
 
-func (s *RemoteStore) GetTeams(tourID int32) ([]*Team, error) {
-	rows, err := s.db.Query(""+
+// GetUpcomingTours returns the tours in [from, until) that haven't
+// been deleted, ordered by time.
+func (s *RemoteStore) GetUpcomingTours(ctx context.Context, from, until time.Time, maxRiders int) ([]*TourDetail, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	wallFrom, wallUntil := wallRange(from, until)
+	rows, err := s.db.QueryContext(ctx, tourDetailQuery+
+		"WHERE Master.TourDateTime >= ? "+
+		"  AND Master.TourDateTime < ? "+
+		"  AND (Master.Deleted <> 1 OR Master.Deleted IS NULL) "+
+		"ORDER BY Master.TourDateTime ASC",
+		wallFrom, wallUntil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tours []*TourDetail
+	for rows.Next() {
+		tourDetail, err := s.scanTourDetail(rows, maxRiders)
+		if err != nil {
+			return nil, err
+		}
+		if inRange(tourDetail.Time, from, until) {
+			tours = append(tours, tourDetail)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Tours in different zones can be out of order by the clock.
+	sort.SliceStable(tours, func(i, j int) bool { return tours[i].Time.Before(tours[j].Time) })
+	return tours, nil
+}
+
+// GetPendingRiders returns the number of riders in orders for the
+// tour that were placed since the given time but haven't completed
+// payment, i.e. checkouts that are probably still in flight.
+func (s *RemoteStore) GetPendingRiders(ctx context.Context, tourID int32, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var count sql.NullInt64 // SUM() can return NULL
+	row := s.db.QueryRowContext(ctx, ""+
+		"SELECT SUM(OrderItems.Riders) "+
+		"FROM OrderItems, OrderMain "+
+		"WHERE OrderItems.OrderNum = OrderMain.OrderNum "+
+		"  AND (OrderMain.Completed = 0 OR OrderMain.Completed IS NULL) "+
+		"  AND OrderMain.DatePlaced >= ? "+
+		"  AND OrderItems.TourID = ?",
+		since, tourID)
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return int(count.Int64), nil
+}
+
+func (s *RemoteStore) GetTeams(ctx context.Context, tourID int32) ([]*Team, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
 		"SELECT GuideName, SweepName "+
 		"FROM Guides "+
 		"WHERE TourID = ? "+
@@ -137,6 +350,10 @@ func (s *RemoteStore) GetTeams(tourID int32) ([]*Team, error) {
 	if err != nil {
 		return nil, err
 	}
+	return scanTeams(rows)
+}
+
+func scanTeams(rows *sql.Rows) ([]*Team, error) {
 	defer rows.Close()
 	var teams []*Team
 	for rows.Next() {
@@ -152,13 +369,512 @@ func (s *RemoteStore) GetTeams(tourID int32) ([]*Team, error) {
 	return teams, nil
 }
 
+// GetTeamVersions returns the versions of a tour's guide assignments,
+// newest first.
+func (s *RemoteStore) GetTeamVersions(ctx context.Context, tourID int32) ([]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT DISTINCT Version "+
+		"FROM Guides "+
+		"WHERE TourID = ? "+
+		"ORDER BY Version DESC",
+		tourID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var v sql.NullInt64
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, int(v.Int64))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (s *RemoteStore) GetTeamsVersion(ctx context.Context, tourID int32, version int) ([]*Team, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT GuideName, SweepName "+
+		"FROM Guides "+
+		"WHERE TourID = ? "+
+		"  AND (Deleted <> 1 OR Deleted IS NULL) "+
+		"  AND Version = ? "+
+		"ORDER BY RecordNum ASC",
+		tourID, version)
+	if err != nil {
+		return nil, err
+	}
+	return scanTeams(rows)
+}
+
+// CreateTeamsVersion records teams as the next version of the tour's
+// guide assignments and returns the new version number along with the
+// teams it replaced, read under the same lock so that concurrent
+// editors each see the version they actually replaced.  Earlier
+// versions are left untouched.  An empty teams list is recorded as a
+// single deleted row so that the new version still exists.
+func (s *RemoteStore) CreateTeamsVersion(ctx context.Context, tourID int32, teams []*Team) (int, []*Team, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	version, previous, err := s.prepareCreateTeamsVersion(ctx, tx, tourID, teams)
+	if err != nil {
+		tx.Rollback()
+		return 0, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return version, previous, nil
+}
+
+func (s *RemoteStore) prepareCreateTeamsVersion(ctx context.Context, tx *sql.Tx, tourID int32, teams []*Team) (int, []*Team, error) {
+	// FOR UPDATE serializes concurrent editors of the same tour.
+	var latest sql.NullInt64
+	row := tx.QueryRowContext(ctx, "SELECT Max(Version) FROM Guides WHERE TourID = ? FOR UPDATE", tourID)
+	if err := row.Scan(&latest); err != nil {
+		return 0, nil, err
+	}
+	var previous []*Team
+	if latest.Valid {
+		rows, err := tx.QueryContext(ctx, ""+
+			"SELECT GuideName, SweepName "+
+			"FROM Guides "+
+			"WHERE TourID = ? "+
+			"  AND (Deleted <> 1 OR Deleted IS NULL) "+
+			"  AND Version = ? "+
+			"ORDER BY RecordNum ASC",
+			tourID, latest.Int64)
+		if err != nil {
+			return 0, nil, err
+		}
+		if previous, err = scanTeams(rows); err != nil {
+			return 0, nil, err
+		}
+	}
+	version := int(latest.Int64) + 1
+	if len(teams) == 0 {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO Guides (TourID, GuideName, SweepName, Version, Deleted) VALUES (?, ?, ?, ?, ?)",
+			tourID, "", "", version, 1)
+		if err != nil {
+			return 0, nil, err
+		}
+		return version, previous, nil
+	}
+	for _, t := range teams {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO Guides (TourID, GuideName, SweepName, Version, Deleted) VALUES (?, ?, ?, ?, ?)",
+			tourID, t.Guide, t.Sweep, version, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return version, previous, nil
+}
+
+// IsGuide reports whether anyone by this name has been assigned to a
+// tour as a guide or sweep.
+func (s *RemoteStore) IsGuide(ctx context.Context, name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var n int
+	err := s.db.QueryRowContext(ctx, ""+
+		"SELECT COUNT(*) "+
+		"FROM Guides "+
+		"WHERE (GuideName = ? OR SweepName = ?) "+
+		"  AND (Deleted <> 1 OR Deleted IS NULL)",
+		name, name).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetGuideEmails returns the email addresses of the named guides.
+// Guides without a known address are omitted from the result.
+func (s *RemoteStore) GetGuideEmails(ctx context.Context, names []string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	emails := make(map[string]string)
+	if len(names) == 0 {
+		return emails, nil
+	}
+	args := make([]interface{}, len(names))
+	for i, n := range names {
+		args[i] = n
+	}
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT Name, Email "+
+		"FROM GuideContacts "+
+		"WHERE Name IN (?"+strings.Repeat(", ?", len(names)-1)+")",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, email sql.NullString
+		if err := rows.Scan(&name, &email); err != nil {
+			return nil, err
+		}
+		if email.String != "" {
+			emails[name.String] = email.String
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+func (s *RemoteStore) GetGuideTours(ctx context.Context, guide string, from time.Time) ([]*GuideTour, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	wallFrom, _ := wallRange(from, from)
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT Master.TourID, "+
+		"    Master.TourCode, "+
+		"    Master.TourDateTime, "+
+		"    Master.TimeZone, "+
+		"    Master.ConfCode, "+
+		"    Master.Cancelled, "+
+		"    MasterTourInfo.LongName "+
+		"FROM Master "+
+		"LEFT JOIN MasterTourInfo ON Master.TourCode = MasterTourInfo.ShortCode "+
+		"WHERE Master.TourDateTime >= ? "+
+		"  AND (Master.Deleted <> 1 OR Master.Deleted IS NULL) "+
+		"  AND Master.TourID IN ("+
+		"    SELECT g.TourID "+
+		"    FROM Guides g "+
+		"    WHERE (g.GuideName = ? OR g.SweepName = ?) "+
+		"      AND (g.Deleted <> 1 OR g.Deleted IS NULL) "+
+		"      AND g.Version = ("+
+		"        SELECT Max(Version) "+
+		"        FROM Guides "+
+		"        WHERE TourID = g.TourID)) "+
+		"ORDER BY Master.TourDateTime ASC",
+		wallFrom, guide, guide)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tours []*GuideTour
+	for rows.Next() {
+		var (
+			id        int32
+			code      sql.NullString
+			time      mysql.NullTime
+			timeZone  sql.NullString
+			confCode  sql.NullString
+			cancelled sql.NullBool
+			longName  sql.NullString
+		)
+		if err := rows.Scan(&id, &code, &time, &timeZone, &confCode, &cancelled, &longName); err != nil {
+			return nil, err
+		}
+		tour := &GuideTour{
+			Tour: Tour{
+				ID:        id,
+				Code:      code.String,
+				Time:      tourTime(time.Time, s.zones.get(timeZone.String)),
+				ConfCode:  confCode.String,
+				Cancelled: cancelled.Bool,
+			},
+			LongName: longName.String,
+		}
+		if !tour.Time.Before(from) {
+			tours = append(tours, tour)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(tours, func(i, j int) bool { return tours[i].Time.Before(tours[j].Time) })
+	return tours, nil
+}
+
+func (s *RemoteStore) GetRoster(ctx context.Context, tourID int32) ([]*RosterEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT OrderMain.OrderNum, "+
+		"    OrderMain.CustName, "+
+		"    OrderItems.Riders, "+
+		"    OrderMain.Heights, "+
+		"    OrderMain.Mobile, "+
+		"    OrderMain.Hotel, "+
+		"    OrderItems.PrivateNotes, "+
+		"    OrderContacts.EmergencyName, "+
+		"    OrderContacts.EmergencyPhone "+
+		"FROM OrderItems "+
+		"JOIN OrderMain ON OrderItems.OrderNum = OrderMain.OrderNum "+
+		"LEFT JOIN OrderContacts ON OrderMain.OrderNum = OrderContacts.OrderNum "+
+		"WHERE OrderMain.Completed <> 0 "+
+		"  AND (OrderItems.Deleted <> 1 OR OrderItems.Deleted IS NULL) "+
+		"  AND OrderItems.TourID = ? "+
+		"ORDER BY OrderMain.OrderNum ASC",
+		tourID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roster []*RosterEntry
+	for rows.Next() {
+		var (
+			orderID   int32
+			name      sql.NullString
+			numRiders sql.NullInt64
+			heights   sql.NullString
+			mobile    sql.NullString
+			hotel     sql.NullString
+			misc      sql.NullString
+			emergName sql.NullString
+			emergTel  sql.NullString
+		)
+		if err := rows.Scan(&orderID, &name, &numRiders, &heights, &mobile, &hotel, &misc, &emergName, &emergTel); err != nil {
+			return nil, err
+		}
+		roster = append(roster, &RosterEntry{
+			OrderID:   orderID,
+			Name:      name.String,
+			NumRiders: int(numRiders.Int64),
+			Heights:   heights.String,
+			Mobile:    mobile.String,
+			Hotel:     hotel.String,
+			Misc:      misc.String,
+			Emergency: EmergencyContact{emergName.String, emergTel.String},
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(roster) == 0 {
+		return roster, nil
+	}
+
+	// Attach the individual riders.
+	riders, err := s.getTourRiders(ctx, tourID)
+	if err != nil {
+		return nil, err
+	}
+	waivers, err := s.GetTourWaivers(ctx, tourID)
+	if err != nil {
+		return nil, err
+	}
+	signed := make(map[int32][]*WaiverSignature)
+	for _, w := range waivers {
+		signed[w.OrderID] = append(signed[w.OrderID], w)
+	}
+	for _, e := range roster {
+		e.Riders = riders[e.OrderID]
+		e.Waivers = signed[e.OrderID]
+	}
+	return roster, nil
+}
+
+// getTourRiders returns the riders recorded for each order on a tour.
+func (s *RemoteStore) getTourRiders(ctx context.Context, tourID int32) (map[int32][]Rider, error) {
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT OrderRiders.OrderNum, "+
+		"    OrderRiders.Gender, "+
+		"    OrderRiders.HeightInches, "+
+		"    OrderRiders.Name, "+
+		"    OrderRiders.Age "+
+		"FROM OrderRiders, OrderItems "+
+		"WHERE OrderRiders.OrderNum = OrderItems.OrderNum "+
+		"  AND OrderItems.TourID = ? "+
+		"ORDER BY OrderRiders.OrderNum, OrderRiders.RiderIndex",
+		tourID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	riders := make(map[int32][]Rider)
+	for rows.Next() {
+		var (
+			orderID int32
+			gender  sql.NullString
+			height  sql.NullInt64
+			name    sql.NullString
+			age     sql.NullInt64
+		)
+		if err := rows.Scan(&orderID, &gender, &height, &name, &age); err != nil {
+			return nil, err
+		}
+		riders[orderID] = append(riders[orderID], newRider(gender, height, name, age))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return riders, nil
+}
+
+// GetBikeStock returns the number of bikes of each frame size kept at
+// a location (a tour's ConfCode).
+func (s *RemoteStore) GetBikeStock(ctx context.Context, location string) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT FrameSize, SUM(Count) "+
+		"FROM Bikes "+
+		"WHERE Location = ? "+
+		"GROUP BY FrameSize",
+		location)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stock := make(map[string]int)
+	for rows.Next() {
+		var (
+			size  sql.NullString
+			count sql.NullInt64
+		)
+		if err := rows.Scan(&size, &count); err != nil {
+			return nil, err
+		}
+		stock[size.String] = int(count.Int64)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+// GetBookedRiders returns the riders in completed orders on all tours
+// leaving from a location at the given time (in the location's time
+// zone), other than excludeOrderID.  Orders placed before riders were
+// stored individually fall back to parsing OrderMain.Heights.
+func (s *RemoteStore) GetBookedRiders(ctx context.Context, location string, t time.Time, excludeOrderID int32) ([]Rider, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT OrderMain.OrderNum, "+
+		"    OrderMain.Heights, "+
+		"    OrderRiders.RiderIndex, "+
+		"    OrderRiders.Gender, "+
+		"    OrderRiders.HeightInches "+
+		"FROM Master "+
+		"JOIN OrderItems ON Master.TourID = OrderItems.TourID "+
+		"JOIN OrderMain ON OrderItems.OrderNum = OrderMain.OrderNum "+
+		"LEFT JOIN OrderRiders ON OrderMain.OrderNum = OrderRiders.OrderNum "+
+		"WHERE OrderMain.Completed <> 0 "+
+		"  AND (OrderItems.Deleted <> 1 OR OrderItems.Deleted IS NULL) "+
+		"  AND (Master.Deleted <> 1 OR Master.Deleted IS NULL) "+
+		"  AND Master.ConfCode = ? "+
+		"  AND Master.TourDateTime = ? "+
+		"  AND OrderMain.OrderNum <> ? "+
+		"ORDER BY OrderMain.OrderNum, OrderRiders.RiderIndex",
+		location, wallClock(t), excludeOrderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var riders []Rider
+	for rows.Next() {
+		var (
+			orderID int32
+			heights sql.NullString
+			index   sql.NullInt64
+			gender  sql.NullString
+			height  sql.NullInt64
+		)
+		if err := rows.Scan(&orderID, &heights, &index, &gender, &height); err != nil {
+			return nil, err
+		}
+		if !index.Valid {
+			riders = append(riders, parseHeights(heights.String)...)
+			continue
+		}
+		r := Rider{Gender: gender.String, Height: -1}
+		if height.Valid {
+			r.Height = int(height.Int64)
+		}
+		riders = append(riders, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return riders, nil
+}
+
+// GetOrderRiders returns the riders recorded for an order, in the
+// order they were entered.
+func (s *RemoteStore) GetOrderRiders(ctx context.Context, orderID int32) ([]Rider, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT Gender, HeightInches, Name, Age "+
+		"FROM OrderRiders "+
+		"WHERE OrderNum = ? "+
+		"ORDER BY RiderIndex ASC",
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRiders(rows)
+}
+
+func scanRiders(rows *sql.Rows) ([]Rider, error) {
+	defer rows.Close()
+	var riders []Rider
+	for rows.Next() {
+		var (
+			gender sql.NullString
+			height sql.NullInt64
+			name   sql.NullString
+			age    sql.NullInt64
+		)
+		if err := rows.Scan(&gender, &height, &name, &age); err != nil {
+			return nil, err
+		}
+		riders = append(riders, newRider(gender, height, name, age))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return riders, nil
+}
+
+// newRider converts a row of OrderRiders into a Rider.
+func newRider(gender sql.NullString, height sql.NullInt64, name sql.NullString, age sql.NullInt64) Rider {
+	r := Rider{
+		Gender: gender.String,
+		Height: -1,
+		Name:   name.String,
+		Age:    int(age.Int64),
+	}
+	if height.Valid {
+		r.Height = int(height.Int64)
+	}
+	return r
+}
+
 func priceString(total int64) string {
 	return fmt.Sprintf("%d", total/100)
 }
 
+// heightsString summarizes riders for OrderMain.Heights, e.g.
+// "F5'4 M>6'6".  Riders without a gender weren't asked for their
+// heights and are left out.
 func heightsString(riders []Rider) string {
 	var s []string
 	for _, r := range riders {
+		if r.Gender == "" {
+			continue
+		}
 		var h string
 		switch {
 		case r.Height <= 0:
@@ -175,8 +891,8 @@ func heightsString(riders []Rider) string {
 	return strings.Join(s, " ")
 }
 
-func (s *RemoteStore) prepareCreateOrder(tx *sql.Tx, tourID int32, numRiders int, riders []Rider, total int64, name, email, mobile, hotel, misc string) (int32, error) {
-	result, err := tx.Exec(
+func (s *RemoteStore) prepareCreateOrder(ctx context.Context, tx *sql.Tx, tourID int32, numRiders int, riders []Rider, total int64, name, email, mobile, hotel, misc string, contacts OrderContacts) (int32, error) {
+	result, err := tx.ExecContext(ctx,
 		"INSERT INTO OrderMain (CustName, CustEmail, Hotel, Mobile, DatePlaced, Heights) VALUES (?, ?, ?, ?, ?, ?)",
 		name, email, hotel, mobile, time.Now(), heightsString(riders))
 	if err != nil {
@@ -186,21 +902,45 @@ func (s *RemoteStore) prepareCreateOrder(tx *sql.Tx, tourID int32, numRiders int
 	if err != nil {
 		return 0, err
 	}
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(ctx,
 		"INSERT INTO OrderItems (OrderNum, TourID, Riders, Price, Method, PrivateNotes, Deleted) VALUES (?, ?, ?, ?, ?, ?, ?)",
 		orderID, tourID, numRiders, priceString(total), "STw", misc, 0)
 	if err != nil {
 		return 0, err
 	}
+	for i, r := range riders {
+		// Unknown and optional values are stored as NULL.
+		var (
+			height = sql.NullInt64{Int64: int64(r.Height), Valid: r.Height > 0}
+			name   = sql.NullString{String: r.Name, Valid: r.Name != ""}
+			age    = sql.NullInt64{Int64: int64(r.Age), Valid: r.Age > 0}
+		)
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO OrderRiders (OrderNum, RiderIndex, Gender, HeightInches, Name, Age) VALUES (?, ?, ?, ?, ?, ?)",
+			orderID, i, r.Gender, height, name, age)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if contacts != (OrderContacts{}) {
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO OrderContacts (OrderNum, EmergencyName, EmergencyPhone, SMSNumber) VALUES (?, ?, ?, ?)",
+			orderID, contacts.Emergency.Name, contacts.Emergency.Phone, sql.NullString{String: contacts.SMSNumber, Valid: contacts.SMSNumber != ""})
+		if err != nil {
+			return 0, err
+		}
+	}
 	return int32(orderID), nil
 }
 
-func (s *RemoteStore) CreateOrder(tourID int32, numRiders int, riders []Rider, total int64, name, email, mobile, hotel, misc string) (int32, error) {
-	tx, err := s.db.Begin()
+func (s *RemoteStore) CreateOrder(ctx context.Context, tourID int32, numRiders int, riders []Rider, total int64, name, email, mobile, hotel, misc string, contacts OrderContacts) (int32, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
-	orderID, err := s.prepareCreateOrder(tx, tourID, numRiders, riders, total, name, email, mobile, hotel, misc)
+	orderID, err := s.prepareCreateOrder(ctx, tx, tourID, numRiders, riders, total, name, email, mobile, hotel, misc, contacts)
 	if err != nil {
 		tx.Rollback()
 		return 0, err
@@ -211,14 +951,461 @@ func (s *RemoteStore) CreateOrder(tourID int32, numRiders int, riders []Rider, t
 	return orderID, nil
 }
 
-func (s *RemoteStore) UpdateOrderPaymentRecorded(orderID int32) error {
-	_, err := s.db.Exec(
-		"UPDATE OrderMain SET Completed = true WHERE OrderNum = ?", orderID)
-	return err
+// UpdateOrderPaymentRecorded marks an order completed and records the
+// charge so that it can be refunded later.
+func (s *RemoteStore) UpdateOrderPaymentRecorded(ctx context.Context, orderID int32, chargeID string, amount int64) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE OrderMain SET Completed = true WHERE OrderNum = ?", orderID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO OrderPayments (OrderNum, ChargeID, Amount) VALUES (?, ?, ?)",
+		orderID, chargeID, amount); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *RemoteStore) UpdateOrderConfirmationSent(orderID int32) error {
-	_, err := s.db.Exec(
+func (s *RemoteStore) UpdateOrderConfirmationSent(ctx context.Context, orderID int32) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx,
 		"UPDATE OrderItems SET ConfirmationSent = 1 WHERE OrderNum = ?", orderID)
 	return err
 }
+
+// GetWebOrders returns the orders placed through gorez since the given
+// time, whether or not they were completed.
+func (s *RemoteStore) GetWebOrders(ctx context.Context, since time.Time) ([]*WebOrder, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT OrderMain.OrderNum, "+
+		"    OrderItems.TourID, "+
+		"    OrderMain.Completed <> 0, "+
+		"    OrderItems.Price, "+
+		"    OrderPayments.ChargeID, "+
+		"    OrderMain.DatePlaced "+
+		"FROM OrderMain "+
+		"JOIN OrderItems ON OrderMain.OrderNum = OrderItems.OrderNum "+
+		"LEFT JOIN OrderPayments ON OrderMain.OrderNum = OrderPayments.OrderNum "+
+		"WHERE OrderItems.Method = 'STw' "+
+		"  AND (OrderItems.Deleted <> 1 OR OrderItems.Deleted IS NULL) "+
+		"  AND OrderMain.DatePlaced >= ? "+
+		"ORDER BY OrderMain.OrderNum ASC",
+		since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var orders []*WebOrder
+	for rows.Next() {
+		var (
+			orderID   int32
+			tourID    sql.NullInt64
+			completed sql.NullBool
+			price     sql.NullString
+			chargeID  sql.NullString
+			placed    mysql.NullTime
+		)
+		if err := rows.Scan(&orderID, &tourID, &completed, &price, &chargeID, &placed); err != nil {
+			return nil, err
+		}
+		dollars, _ := strconv.ParseInt(price.String, 10, 64)
+		orders = append(orders, &WebOrder{
+			ID:        orderID,
+			TourID:    int32(tourID.Int64),
+			Completed: completed.Bool,
+			Total:     dollars * 100,
+			ChargeID:  chargeID.String,
+			Placed:    placed.Time,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (s *RemoteStore) GetOrder(ctx context.Context, orderID int32) (*Order, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var (
+		tourID    sql.NullInt64
+		numRiders sql.NullInt64
+		name      sql.NullString
+		email     sql.NullString
+		mobile    sql.NullString
+		smsNumber sql.NullString
+		completed sql.NullBool
+	)
+	row := s.db.QueryRowContext(ctx, ""+
+		"SELECT OrderItems.TourID, "+
+		"    OrderItems.Riders, "+
+		"    OrderMain.CustName, "+
+		"    OrderMain.CustEmail, "+
+		"    OrderMain.Mobile, "+
+		"    OrderContacts.SMSNumber, "+
+		"    OrderMain.Completed <> 0 "+
+		"FROM OrderItems "+
+		"JOIN OrderMain ON OrderItems.OrderNum = OrderMain.OrderNum "+
+		"LEFT JOIN OrderContacts ON OrderMain.OrderNum = OrderContacts.OrderNum "+
+		"WHERE (OrderItems.Deleted <> 1 OR OrderItems.Deleted IS NULL) "+
+		"  AND OrderMain.OrderNum = ?",
+		orderID)
+	if err := row.Scan(&tourID, &numRiders, &name, &email, &mobile, &smsNumber, &completed); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	riders, err := s.GetOrderRiders(ctx, orderID)
+	if err != nil {
+		return nil, false, err
+	}
+	return &Order{
+		ID:        orderID,
+		TourID:    int32(tourID.Int64),
+		NumRiders: int(numRiders.Int64),
+		Name:      name.String,
+		Email:     email.String,
+		Mobile:    mobile.String,
+		SMSNumber: smsNumber.String,
+		Completed: completed.Bool,
+		Riders:    riders,
+	}, true, nil
+}
+
+// CreateWaiverSignature records a signature.  It returns false if the
+// rider has already signed this version of the waiver, in which case
+// the earlier signature is kept.
+func (s *RemoteStore) CreateWaiverSignature(ctx context.Context, sig *WaiverSignature) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx,
+		"INSERT IGNORE INTO Waivers (OrderNum, RiderIndex, SignedName, SignedAt, IP, WaiverVersion) VALUES (?, ?, ?, ?, ?, ?)",
+		sig.OrderID, sig.RiderIndex, sig.SignedName, sig.SignedAt, sig.IP, sig.Version)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *RemoteStore) GetOrderWaivers(ctx context.Context, orderID int32) ([]*WaiverSignature, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT OrderNum, RiderIndex, SignedName, SignedAt, IP, WaiverVersion "+
+		"FROM Waivers "+
+		"WHERE OrderNum = ? "+
+		"ORDER BY RiderIndex, SignedAt",
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	return scanWaivers(rows)
+}
+
+func (s *RemoteStore) GetTourWaivers(ctx context.Context, tourID int32) ([]*WaiverSignature, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT Waivers.OrderNum, "+
+		"    Waivers.RiderIndex, "+
+		"    Waivers.SignedName, "+
+		"    Waivers.SignedAt, "+
+		"    Waivers.IP, "+
+		"    Waivers.WaiverVersion "+
+		"FROM Waivers, OrderItems "+
+		"WHERE Waivers.OrderNum = OrderItems.OrderNum "+
+		"  AND OrderItems.TourID = ? "+
+		"ORDER BY Waivers.OrderNum, Waivers.RiderIndex, Waivers.SignedAt",
+		tourID)
+	if err != nil {
+		return nil, err
+	}
+	return scanWaivers(rows)
+}
+
+func scanWaivers(rows *sql.Rows) ([]*WaiverSignature, error) {
+	defer rows.Close()
+	var sigs []*WaiverSignature
+	for rows.Next() {
+		var (
+			sig      WaiverSignature
+			signedAt mysql.NullTime
+			ip       sql.NullString
+		)
+		if err := rows.Scan(&sig.OrderID, &sig.RiderIndex, &sig.SignedName, &signedAt, &ip, &sig.Version); err != nil {
+			return nil, err
+		}
+		sig.SignedAt = signedAt.Time
+		sig.IP = ip.String
+		sigs = append(sigs, &sig)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sigs, nil
+}
+
+// GetNoticeOrders returns completed orders on tours starting in
+// [tourFrom, tourUntil) that haven't been cancelled or deleted, and
+// that don't yet have a notice of the given kind sent or claimed since
+// staleClaim.  Orders placed less than minNotice before their tour are
+// left out.  Riders aren't filled in.
+func (s *RemoteStore) GetNoticeOrders(ctx context.Context, kind string, tourFrom, tourUntil time.Time, minNotice time.Duration, staleClaim time.Time) ([]*Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	wallFrom, wallUntil := wallRange(tourFrom, tourUntil)
+	rows, err := s.db.QueryContext(ctx, orderQuery+
+		"LEFT JOIN OrderNotices ON OrderMain.OrderNum = OrderNotices.OrderNum AND OrderNotices.Kind = ? "+
+		"WHERE Master.TourDateTime >= ? "+
+		"  AND Master.TourDateTime < ? "+
+		"  AND (Master.Cancelled <> 1 OR Master.Cancelled IS NULL) "+
+		"  AND (Master.Deleted <> 1 OR Master.Deleted IS NULL) "+
+		"  AND (OrderItems.Deleted <> 1 OR OrderItems.Deleted IS NULL) "+
+		"  AND OrderMain.Completed <> 0 "+
+		"  AND (OrderNotices.OrderNum IS NULL "+
+		"    OR (OrderNotices.SentAt IS NULL AND OrderNotices.ClaimedAt < ?)) "+
+		"ORDER BY OrderMain.OrderNum ASC",
+		kind, wallFrom, wallUntil, staleClaim)
+	if err != nil {
+		return nil, err
+	}
+	all, err := s.scanOrders(rows)
+	if err != nil {
+		return nil, err
+	}
+	// DatePlaced is in UTC and TourDateTime in the tour's zone, so
+	// these are compared here rather than in SQL.
+	var orders []*Order
+	for _, order := range all {
+		if inRange(order.TourTime, tourFrom, tourUntil) && order.Placed.Before(order.TourTime.Add(-minNotice)) {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// GetTourOrders returns the completed orders on a tour.  Riders aren't
+// filled in.
+func (s *RemoteStore) GetTourOrders(ctx context.Context, tourID int32) ([]*Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, orderQuery+
+		"WHERE Master.TourID = ? "+
+		"  AND (OrderItems.Deleted <> 1 OR OrderItems.Deleted IS NULL) "+
+		"  AND OrderMain.Completed <> 0 "+
+		"ORDER BY OrderMain.OrderNum ASC",
+		tourID)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanOrders(rows)
+}
+
+// GetTourPayments returns the recorded charges for orders on a tour,
+// keyed by order ID.  Orders paid before charges were recorded have
+// no entry.
+func (s *RemoteStore) GetTourPayments(ctx context.Context, tourID int32) (map[int32]*Payment, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT OrderPayments.OrderNum, "+
+		"    OrderPayments.ChargeID, "+
+		"    OrderPayments.Amount, "+
+		"    OrderPayments.RefundID, "+
+		"    OrderPayments.RefundedAt "+
+		"FROM OrderPayments, OrderItems "+
+		"WHERE OrderPayments.OrderNum = OrderItems.OrderNum "+
+		"  AND OrderItems.TourID = ?",
+		tourID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	payments := make(map[int32]*Payment)
+	for rows.Next() {
+		var (
+			p          Payment
+			refundID   sql.NullString
+			refundedAt mysql.NullTime
+		)
+		if err := rows.Scan(&p.OrderID, &p.ChargeID, &p.Amount, &refundID, &refundedAt); err != nil {
+			return nil, err
+		}
+		p.RefundID = refundID.String
+		p.RefundedAt = refundedAt.Time
+		payments[p.OrderID] = &p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+func (s *RemoteStore) UpdatePaymentRefunded(ctx context.Context, orderID int32, refundID string, refundedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE OrderPayments SET RefundID = ?, RefundedAt = ? WHERE OrderNum = ?",
+		refundID, refundedAt, orderID)
+	return err
+}
+
+func (s *RemoteStore) UpdateTourCancelled(ctx context.Context, tourID int32) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE Master SET Cancelled = 1 WHERE TourID = ?", tourID)
+	return err
+}
+
+// orderQuery selects the columns read by scanOrders for completed
+// orders.  Callers append any further joins and a WHERE clause.
+const orderQuery = "" +
+	"SELECT OrderMain.OrderNum, " +
+	"    OrderItems.TourID, " +
+	"    OrderItems.Riders, " +
+	"    OrderMain.CustName, " +
+	"    OrderMain.CustEmail, " +
+	"    OrderMain.Mobile, " +
+	"    OrderContacts.SMSNumber, " +
+	"    Master.TourDateTime, " +
+	"    Master.TimeZone, " +
+	"    OrderMain.DatePlaced " +
+	"FROM Master " +
+	"JOIN OrderItems ON Master.TourID = OrderItems.TourID " +
+	"JOIN OrderMain ON OrderItems.OrderNum = OrderMain.OrderNum " +
+	"LEFT JOIN OrderContacts ON OrderMain.OrderNum = OrderContacts.OrderNum "
+
+func (s *RemoteStore) scanOrders(rows *sql.Rows) ([]*Order, error) {
+	defer rows.Close()
+	var orders []*Order
+	for rows.Next() {
+		var (
+			orderID   int32
+			tourID    sql.NullInt64
+			numRiders sql.NullInt64
+			name      sql.NullString
+			email     sql.NullString
+			mobile    sql.NullString
+			smsNumber sql.NullString
+			tourWall  mysql.NullTime
+			timeZone  sql.NullString
+			placed    mysql.NullTime
+		)
+		if err := rows.Scan(&orderID, &tourID, &numRiders, &name, &email, &mobile, &smsNumber, &tourWall, &timeZone, &placed); err != nil {
+			return nil, err
+		}
+		orders = append(orders, &Order{
+			ID:        orderID,
+			TourID:    int32(tourID.Int64),
+			NumRiders: int(numRiders.Int64),
+			Name:      name.String,
+			Email:     email.String,
+			Mobile:    mobile.String,
+			SMSNumber: smsNumber.String,
+			Completed: true,
+			TourTime:  tourTime(tourWall.Time, s.zones.get(timeZone.String)),
+			Placed:    placed.Time,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// ClaimNotice records that instance is about to send a notice of the
+// given kind for an order.  It returns false if the notice was already
+// sent, or claimed by another instance since staleClaim.
+func (s *RemoteStore) ClaimNotice(ctx context.Context, orderID int32, kind, instance string, now, staleClaim time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	// MySQL reports 1 affected row for an insert, 2 for an update,
+	// and 0 if the existing row was left unchanged.
+	result, err := s.db.ExecContext(ctx, ""+
+		"INSERT INTO OrderNotices (OrderNum, Kind, ClaimedBy, ClaimedAt) VALUES (?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE "+
+		"  ClaimedBy = IF(SentAt IS NULL AND ClaimedAt < ?, VALUES(ClaimedBy), ClaimedBy), "+
+		"  ClaimedAt = IF(SentAt IS NULL AND ClaimedAt < ?, VALUES(ClaimedAt), ClaimedAt)",
+		orderID, kind, instance, now, staleClaim, staleClaim)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *RemoteStore) UpdateNoticeSent(ctx context.Context, orderID int32, kind string, sentAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE OrderNotices SET SentAt = ? WHERE OrderNum = ? AND Kind = ?",
+		sentAt, orderID, kind)
+	return err
+}
+
+// SaveFeedback records feedback for an order, replacing any earlier
+// feedback for the same order.
+func (s *RemoteStore) SaveFeedback(ctx context.Context, fb *Feedback) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, ""+
+		"INSERT INTO Feedback (OrderNum, TourID, Rating, Comments, CreatedAt) VALUES (?, ?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE Rating = VALUES(Rating), Comments = VALUES(Comments), CreatedAt = VALUES(CreatedAt)",
+		fb.OrderID, fb.TourID, fb.Rating, fb.Comments, fb.CreatedAt)
+	return err
+}
+
+// GetFeedback returns feedback left since the given time, most recent
+// first.
+func (s *RemoteStore) GetFeedback(ctx context.Context, since time.Time) ([]*Feedback, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, ""+
+		"SELECT OrderNum, TourID, Rating, Comments, CreatedAt "+
+		"FROM Feedback "+
+		"WHERE CreatedAt >= ? "+
+		"ORDER BY CreatedAt DESC",
+		since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var feedback []*Feedback
+	for rows.Next() {
+		var (
+			fb        Feedback
+			comments  sql.NullString
+			createdAt mysql.NullTime
+		)
+		if err := rows.Scan(&fb.OrderID, &fb.TourID, &fb.Rating, &comments, &createdAt); err != nil {
+			return nil, err
+		}
+		fb.Comments = comments.String
+		fb.CreatedAt = createdAt.Time
+		feedback = append(feedback, &fb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return feedback, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// TeamChange describes one team that differs between two versions of
+// a tour's guide assignments.
+type TeamChange struct {
+	Index int   // 1-based team number
+	Old   *Team // nil if the team was added
+	New   *Team // nil if the team was removed
+}
+
+// diffTeams compares two versions of a tour's teams position by
+// position and returns the teams that differ.
+func diffTeams(old, new []*Team) []*TeamChange {
+	var changes []*TeamChange
+	for i := 0; i < len(old) || i < len(new); i++ {
+		var o, n *Team
+		if i < len(old) {
+			o = old[i]
+		}
+		if i < len(new) {
+			n = new[i]
+		}
+		if o != nil && n != nil && *o == *n {
+			continue
+		}
+		changes = append(changes, &TeamChange{i + 1, o, n})
+	}
+	return changes
+}
+
+// assignments maps each guide and sweep to a description of their
+// roles, e.g. {"Carlos": "guide of team 1", "Roger": "sweep of team 1"}.
+func assignments(teams []*Team) map[string]string {
+	roles := make(map[string][]string)
+	for i, t := range teams {
+		if t.Guide != "" {
+			roles[t.Guide] = append(roles[t.Guide], fmt.Sprintf("guide of team %d", i+1))
+		}
+		if t.Sweep != "" {
+			roles[t.Sweep] = append(roles[t.Sweep], fmt.Sprintf("sweep of team %d", i+1))
+		}
+	}
+	result := make(map[string]string)
+	for name, r := range roles {
+		result[name] = strings.Join(r, ", ")
+	}
+	return result
+}
+
+// affectedGuides returns the sorted names of everyone whose
+// assignment differs between the two versions.
+func affectedGuides(old, new []*Team) []string {
+	before, after := assignments(old), assignments(new)
+	var names []string
+	for name, role := range before {
+		if after[name] != role {
+			names = append(names, name)
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GuideAssignmentData is the data passed to the guide assignment
+// email template.
+type GuideAssignmentData struct {
+	Guide      string
+	TourDetail *TourDetail
+	OldRole    string // empty if previously unassigned
+	NewRole    string // empty if no longer assigned
+	Teams      []*Team
+	ToursURL   string // the guide's link to their tours; empty if links can't be signed
+}
+
+// notifyGuides emails everyone whose assignment changed between old
+// and new.  Guides without a known email address are skipped.
+func (s *Server) notifyGuides(ctx context.Context, tourDetail *TourDetail, old, new []*Team, warnings map[warning]bool) {
+	names := affectedGuides(old, new)
+	if len(names) == 0 {
+		return
+	}
+	emails, err := s.store.GetGuideEmails(ctx, names)
+	if err != nil {
+		s.log.Printf("GetGuideEmails: %v", err)
+		warnings[WarningGetGuideEmails] = true
+		return
+	}
+	before, after := assignments(old), assignments(new)
+	for _, name := range names {
+		email, ok := emails[name]
+		if !ok {
+			continue
+		}
+		data := &GuideAssignmentData{
+			Guide:      name,
+			TourDetail: tourDetail,
+			OldRole:    before[name],
+			NewRole:    after[name],
+			Teams:      new,
+			ToursURL:   s.guideLink(name),
+		}
+		if err := s.emailGuide(ctx, email, data); err != nil {
+			s.log.Printf("Error emailing guide %s: %v", name, err)
+			warnings[WarningEmailGuide] = true
+		}
+	}
+}
+
+func (s *Server) emailGuide(ctx context.Context, email string, data *GuideAssignmentData) error {
+	tmpl, err := s.emailTemplates.Get("guide_assignment.txt")
+	if err != nil {
+		return fmt.Errorf("load guide assignment email template: %v", err)
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return fmt.Errorf("execute guide assignment email template: %v", err)
+	}
+	from := mail.NewEmail("Bike the Big Apple reservations", "reservations@bikethebigapple.com")
+	to := mail.NewEmail(data.Guide, email)
+	subject := fmt.Sprintf("%s-%s | assignment update", data.TourDetail.Time.Format("Jan2"), data.TourDetail.Code)
+	if err := s.sendEmail(ctx, from, to, nil /*bcc*/, subject, body.String()); err != nil {
+		return fmt.Errorf("send guide assignment email: %v", err)
+	}
+	return nil
+}
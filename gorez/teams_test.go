@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffTeams(t *testing.T) {
+	a := &Team{"Carlos", "Roger"}
+	b := &Team{"Ana", "Sam"}
+	c := &Team{"Carlos", "Sam"}
+	tests := []struct {
+		name     string
+		old, new []*Team
+		want     []*TeamChange
+	}{
+		{"same", []*Team{a, b}, []*Team{a, b}, nil},
+		{"both empty", nil, nil, nil},
+		{"added", []*Team{a}, []*Team{a, b}, []*TeamChange{{2, nil, b}}},
+		{"removed", []*Team{a, b}, []*Team{a}, []*TeamChange{{2, b, nil}}},
+		{"changed", []*Team{a, b}, []*Team{c, b}, []*TeamChange{{1, a, c}}},
+		{"equal values", []*Team{{"Carlos", "Roger"}}, []*Team{{"Carlos", "Roger"}}, nil},
+		{"swapped", []*Team{a, b}, []*Team{b, a}, []*TeamChange{{1, a, b}, {2, b, a}}},
+	}
+	for _, tt := range tests {
+		if got := diffTeams(tt.old, tt.new); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffTeams = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	teams := []*Team{{"Carlos", "Roger"}, {"Ana", ""}, {"Roger", "Carlos"}}
+	want := map[string]string{
+		"Carlos": "guide of team 1, sweep of team 3",
+		"Roger":  "sweep of team 1, guide of team 3",
+		"Ana":    "guide of team 2",
+	}
+	if got := assignments(teams); !reflect.DeepEqual(got, want) {
+		t.Errorf("assignments = %v, want %v", got, want)
+	}
+}
+
+func TestAffectedGuides(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new []*Team
+		want     []string
+	}{
+		{"unchanged", []*Team{{"Carlos", "Roger"}}, []*Team{{"Carlos", "Roger"}}, nil},
+		{"first assignment", nil, []*Team{{"Carlos", "Roger"}}, []string{"Carlos", "Roger"}},
+		{"all removed", []*Team{{"Carlos", "Roger"}}, nil, []string{"Carlos", "Roger"}},
+		{"sweep replaced", []*Team{{"Carlos", "Roger"}}, []*Team{{"Carlos", "Sam"}}, []string{"Roger", "Sam"}},
+		{"roles swapped", []*Team{{"Carlos", "Roger"}}, []*Team{{"Roger", "Carlos"}}, []string{"Carlos", "Roger"}},
+		// Ana's team number changes, so she is told; Carlos keeps his.
+		{"team removed", []*Team{{"Carlos", ""}, {"Sam", ""}, {"Ana", ""}}, []*Team{{"Carlos", ""}, {"Ana", ""}}, []string{"Ana", "Sam"}},
+	}
+	for _, tt := range tests {
+		if got := affectedGuides(tt.old, tt.new); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: affectedGuides = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	texttemplate "text/template"
+)
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+//go:embed email_templates/*.txt
+var embeddedEmailTemplates embed.FS
+
+// pageLayout is parsed along with every page template.  layout.html
+// is the page skeleton; each page fills in its blocks, e.g. "content".
+var pageLayout = []string{"layout.html", "partials.html"}
+
+// pageTemplates are the web page templates used by handlers.
+var pageTemplates = []string{
+	"admin_cancel.html",
+	"admin_feedback.html",
+	"admin_notify.html",
+	"admin_planner.html",
+	"admin_teams.html",
+	"checkout.html",
+	"checkout_error.html",
+	"confirmation.html",
+	"confirmation_error.html",
+	"feedback.html",
+	"guide_tours.html",
+	"notfound.html",
+	"waiver.html",
+}
+
+// emailTemplates are the email templates, which are read from
+// -email_templates_dir.  btba.txt and customer.txt aren't part of this
+// repository; the others have defaults in email_templates, used when
+// the directory doesn't have them.  Those in localizedEmailTemplates
+// may also have translations, e.g. customer.es.txt, which are used
+// when present.
+var emailTemplates = []string{
+	"btba.txt",
+	"cancellation.txt",
+	"customer.txt",
+	"followup.txt",
+	"guide_assignment.txt",
+	"reminder.txt",
+}
+
+var localizedEmailTemplates = []string{"customer.txt"}
+
+// Template is satisfied by both html/template and text/template.
+type Template interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// Templates holds a set of templates parsed at startup, keyed by file
+// name.  With reload set, templates are parsed again whenever one of
+// the files changes on disk, so edits show up without a restart.
+type Templates struct {
+	fsys     fs.FS
+	names    []string
+	optional map[string]bool // names that may be missing
+	shared   []string        // parsed ahead of each template in names
+	parse    func(fsys fs.FS, files ...string) (Template, error)
+	reload   bool
+
+	mu      sync.Mutex
+	parsed  map[string]Template
+	modTime time.Time // latest file modification time at last parse
+}
+
+// loadPageTemplates parses the web page templates from dir, or from
+// those embedded in the binary if dir is empty.
+func loadPageTemplates(dir string, reload bool) (*Templates, error) {
+	var fsys fs.FS
+	if dir == "" {
+		sub, err := fs.Sub(embeddedTemplates, "templates")
+		if err != nil {
+			return nil, err
+		}
+		fsys, reload = sub, false // embedded files never change
+	} else {
+		fsys = os.DirFS(dir)
+	}
+	return loadTemplates(fsys, pageTemplates, nil, pageLayout, reload, func(fsys fs.FS, files ...string) (Template, error) {
+		return template.ParseFS(fsys, files...)
+	})
+}
+
+// loadEmailTemplates parses the email templates from dir.
+func loadEmailTemplates(dir string, reload bool) (*Templates, error) {
+	if dir == "" {
+		dir = "."
+	}
+	names := append([]string(nil), emailTemplates...)
+	optional := make(map[string]bool)
+	for _, name := range localizedEmailTemplates {
+		for _, lang := range languages {
+			if lang != defaultLanguage {
+				names = append(names, localizedName(name, lang))
+				optional[localizedName(name, lang)] = true
+			}
+		}
+	}
+	defaults, err := fs.Sub(embeddedEmailTemplates, "email_templates")
+	if err != nil {
+		return nil, err
+	}
+	fsys := overlayFS{os.DirFS(dir), defaults}
+	return loadTemplates(fsys, names, optional, nil, reload, func(fsys fs.FS, files ...string) (Template, error) {
+		return texttemplate.ParseFS(fsys, files...)
+	})
+}
+
+// overlayFS serves files from top, or from bottom if top doesn't have
+// them.
+type overlayFS struct {
+	top, bottom fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.bottom.Open(name)
+	}
+	return f, err
+}
+
+func loadTemplates(fsys fs.FS, names []string, optional map[string]bool, shared []string, reload bool, parse func(fs.FS, ...string) (Template, error)) (*Templates, error) {
+	t := &Templates{
+		fsys:     fsys,
+		names:    names,
+		optional: optional,
+		shared:   shared,
+		parse:    parse,
+		reload:   reload,
+	}
+	modTime, err := t.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.parseAll(modTime); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Get returns the named template.
+func (t *Templates) Get(name string) (Template, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refresh(); err != nil {
+		return nil, err
+	}
+	tmpl, ok := t.parsed[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template %s", name)
+	}
+	return tmpl, nil
+}
+
+// Has reports whether an optional template is present.
+func (t *Templates) Has(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refresh(); err != nil {
+		return false
+	}
+	_, ok := t.parsed[name]
+	return ok
+}
+
+// Check returns an error if the templates can't be read or a required
+// one is missing.
+func (t *Templates) Check() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	for _, name := range t.names {
+		if _, ok := t.parsed[name]; !ok && !t.optional[name] {
+			return fmt.Errorf("missing template %s", name)
+		}
+	}
+	return nil
+}
+
+// refresh parses the templates again if reload is set and they have
+// changed.  The caller must hold mu.
+func (t *Templates) refresh() error {
+	if !t.reload {
+		return nil
+	}
+	modTime, err := t.latestModTime()
+	if err != nil {
+		return err
+	}
+	if modTime.After(t.modTime) {
+		return t.parseAll(modTime)
+	}
+	return nil
+}
+
+// parseAll parses every template, keeping the previous set if any of
+// them fails.
+func (t *Templates) parseAll(modTime time.Time) error {
+	parsed := make(map[string]Template)
+	for _, name := range t.names {
+		if t.optional[name] && !t.exists(name) {
+			continue
+		}
+		files := append(append([]string(nil), t.shared...), name)
+		tmpl, err := t.parse(t.fsys, files...)
+		if err != nil {
+			return err
+		}
+		parsed[name] = tmpl
+	}
+	t.parsed, t.modTime = parsed, modTime
+	return nil
+}
+
+func (t *Templates) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range append(append([]string(nil), t.shared...), t.names...) {
+		if t.optional[name] && !t.exists(name) {
+			continue
+		}
+		info, err := fs.Stat(t.fsys, name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (t *Templates) exists(name string) bool {
+	_, err := fs.Stat(t.fsys, name)
+	return err == nil
+}
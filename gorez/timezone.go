@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+	_ "time/tzdata" // zones resolve even on hosts without a zoneinfo database
+)
+
+const (
+	defaultTimeZone = "America/New_York" // for tours that don't name one
+
+	// maxZoneOffset bounds how far any zone's clock is from UTC.
+	// Master.TourDateTime holds each tour's local clock reading, so
+	// range queries on it are widened by this much and the results
+	// filtered on absolute time.
+	maxZoneOffset = 14 * time.Hour
+)
+
+// zoneCache resolves Master.TimeZone names, falling back to the
+// default zone for tours with no zone or one Go doesn't know.
+type zoneCache struct {
+	fallback *time.Location
+	mu       sync.Mutex
+	byName   map[string]*time.Location
+}
+
+func newZoneCache(fallback *time.Location) *zoneCache {
+	return &zoneCache{
+		fallback: fallback,
+		byName:   make(map[string]*time.Location),
+	}
+}
+
+func (z *zoneCache) get(name string) *time.Location {
+	// "Local" would make times depend on where the server runs.
+	if name == "" || name == "Local" {
+		return z.fallback
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if loc, ok := z.byName[name]; ok {
+		return loc
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		loc = z.fallback
+	}
+	z.byName[name] = loc
+	return loc
+}
+
+// tourTime converts a Master.TourDateTime, which the driver returns as
+// a clock reading labelled UTC, to the absolute time it denotes in the
+// tour's zone.  The result formats as the tour's local time.
+func tourTime(wall time.Time, loc *time.Location) time.Time {
+	if wall.IsZero() {
+		return wall
+	}
+	return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), loc)
+}
+
+// wallClock is the inverse of tourTime: the clock reading of t in its
+// own location, labelled UTC, as Master.TourDateTime stores it.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// wallRange returns bounds on Master.TourDateTime that take in every
+// tour in [from, until), whatever its zone, along with some outside
+// it.  Callers filter the results on Tour.Time.
+func wallRange(from, until time.Time) (time.Time, time.Time) {
+	return from.UTC().Add(-maxZoneOffset), until.UTC().Add(maxZoneOffset)
+}
+
+// inRange reports whether t is in [from, until).
+func inRange(t, from, until time.Time) bool {
+	return !t.Before(from) && t.Before(until)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q): %v", name, err)
+	}
+	return loc
+}
+
+func TestZoneCache(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	z := newZoneCache(ny)
+	for _, name := range []string{"", "Local", "Not/AZone"} {
+		if got := z.get(name); got != ny {
+			t.Errorf("get(%q) = %v, want fallback %v", name, got, ny)
+		}
+	}
+	if got := z.get("Europe/Prague"); got.String() != "Europe/Prague" {
+		t.Errorf("get(Europe/Prague) = %v", got)
+	}
+	if z.get("Europe/Prague") != z.get("Europe/Prague") {
+		t.Error("get(Europe/Prague) isn't cached")
+	}
+}
+
+func TestTourTime(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	prague := mustLoad(t, "Europe/Prague")
+	tests := []struct {
+		wall    time.Time
+		loc     *time.Location
+		wantUTC time.Time
+	}{
+		// Either side of the US change on 8 March 2026.
+		{time.Date(2026, 3, 7, 10, 0, 0, 0, time.UTC), ny, time.Date(2026, 3, 7, 15, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 3, 9, 10, 0, 0, 0, time.UTC), ny, time.Date(2026, 3, 9, 14, 0, 0, 0, time.UTC)},
+		// In the weeks the US has changed and Europe hasn't.
+		{time.Date(2026, 3, 20, 10, 0, 0, 0, time.UTC), prague, time.Date(2026, 3, 20, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 4, 1, 10, 0, 0, 0, time.UTC), prague, time.Date(2026, 4, 1, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got := tourTime(tt.wall, tt.loc)
+		if !got.Equal(tt.wantUTC) {
+			t.Errorf("tourTime(%v, %v) = %v, want %v", tt.wall, tt.loc, got.UTC(), tt.wantUTC)
+		}
+		if got.Location() != tt.loc || got.Hour() != tt.wall.Hour() {
+			t.Errorf("tourTime(%v, %v) = %v, want the same clock reading in %v", tt.wall, tt.loc, got, tt.loc)
+		}
+		if back := wallClock(got); !back.Equal(tt.wall) {
+			t.Errorf("wallClock(%v) = %v, want %v", got, back, tt.wall)
+		}
+	}
+	if got := tourTime(time.Time{}, ny); !got.IsZero() {
+		t.Errorf("tourTime(zero) = %v, want zero", got)
+	}
+}
+
+func TestWallRange(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	prague := mustLoad(t, "Europe/Prague")
+	from := time.Date(2026, 3, 8, 0, 0, 0, 0, ny)
+	until := from.AddDate(0, 0, 1)
+	lo, hi := wallRange(from, until)
+
+	// Every tour on 8 March in New York, a 23-hour day, has its stored
+	// clock reading inside the range whatever its zone, and passes the
+	// filter.
+	for _, tour := range []time.Time{
+		from,
+		time.Date(2026, 3, 8, 23, 59, 0, 0, ny),
+		time.Date(2026, 3, 8, 6, 0, 0, 0, prague),
+		time.Date(2026, 3, 9, 4, 59, 0, 0, prague),
+	} {
+		wall := wallClock(tour)
+		if wall.Before(lo) || !wall.Before(hi) {
+			t.Errorf("wallClock(%v) = %v, outside [%v, %v)", tour, wall, lo, hi)
+		}
+		if !inRange(tour, from, until) {
+			t.Errorf("inRange(%v) = false, want true", tour)
+		}
+	}
+	// Tours just outside the day are filtered out.
+	for _, tour := range []time.Time{
+		from.Add(-time.Minute),
+		until,
+		time.Date(2026, 3, 8, 5, 59, 0, 0, prague),
+	} {
+		if inRange(tour, from, until) {
+			t.Errorf("inRange(%v) = true, want false", tour)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// waiverVersion names the current waiver text.  Bump it whenever
+// waiverTexts gains a new entry; signatures record the version they
+// agreed to, so old texts must be kept for export.
+const waiverVersion = "2026-10"
+
+var waiverTexts = map[string][]string{
+	"2026-10": {
+		"I acknowledge that bicycle touring involves risks, including collisions with vehicles, pedestrians, other cyclists and fixed objects, falls caused by road surfaces, weather or equipment, and injury from physical exertion.",
+		"I confirm that I am physically able to take part in the tour, that I can ride a bicycle safely in city traffic, and that I will follow the instructions of my guides and all traffic laws.",
+		"I agree to wear the helmet provided or my own, and to inspect the bicycle before riding and tell my guide of any problem with it.",
+		"I am responsible for the bicycle and equipment lent to me and will pay for loss or damage beyond normal wear.",
+		"To the fullest extent permitted by law, I release Bike the Big Apple, its owners, guides and agents from all liability for injury, loss or damage arising from my participation in the tour, except where caused by their gross negligence.",
+		"If I am signing on behalf of a rider under 18, I am their parent or legal guardian and I accept these terms on their behalf.",
+	},
+}
+
+// CurrentWaivers returns the signatures of the current waiver version,
+// one per rider.  Riders who only signed an earlier version haven't
+// signed.
+func (e *RosterEntry) CurrentWaivers() []*WaiverSignature {
+	signed := make(map[int]bool)
+	var sigs []*WaiverSignature
+	for _, w := range e.Waivers {
+		if w.Version == waiverVersion && !signed[w.RiderIndex] {
+			signed[w.RiderIndex] = true
+			sigs = append(sigs, w)
+		}
+	}
+	return sigs
+}
+
+// WaiverLink is a per-rider link to the waiver form.
+type WaiverLink struct {
+	Display int // 1-based rider number
+	URL     string
+}
+
+// waiverLinks returns a waiver link for each rider in an order, or
+// nil if links can't be signed.
+func (s *Server) waiverLinks(orderID int32, numRiders int) []*WaiverLink {
+	token := s.sign("waiver", strconv.Itoa(int(orderID)))
+	if token == "" {
+		return nil
+	}
+	var links []*WaiverLink
+	for i := 0; i < numRiders; i++ {
+		links = append(links, &WaiverLink{
+			Display: i + 1,
+			URL:     fmt.Sprintf("%s/waiver?OrderNum=%d&Rider=%d&Token=%s", s.baseURL, orderID, i, token),
+		})
+	}
+	return links
+}
+
+// WaiverVars represents the form inputs.
+type WaiverVars struct {
+	OrderID    int32 `schema:"OrderNum"`
+	Rider      int
+	Token      string
+	SignedName string
+	Agree      bool
+	Version    string
+}
+
+// WaiverData is the data passed to the waiver template.
+type WaiverData struct {
+	TourDetail   *TourDetail
+	OrderID      int32
+	Rider        int
+	RiderDisplay int
+	RiderName    string // suggested name, may be empty
+	Token        string
+	Version      string
+	Text         []string
+	Signed       *WaiverSignature // non-nil once this rider has signed
+	Problem      string           // why the last submission was rejected
+
+	Page
+}
+
+func (s *Server) waiver(r *http.Request) (*WaiverData, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if err := r.ParseForm(); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars WaiverVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	if !s.verify(vars.Token, "waiver", strconv.Itoa(int(vars.OrderID))) {
+		return nil, warnings, &appError{http.StatusForbidden, "This waiver link is not valid. Please use the link from your confirmation email.", nil}
+	}
+	order, ok, err := s.store.GetOrder(r.Context(), vars.OrderID)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetOrder: %v", err)}
+	}
+	if !ok || vars.Rider < 0 || vars.Rider >= order.NumRiders {
+		return nil, warnings, &appError{http.StatusNotFound, "This waiver link is not valid. Please use the link from your confirmation email.", nil}
+	}
+	tourDetail, ok, err := s.store.GetTourDetailByID(r.Context(), order.TourID, maxRiders)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourDetailByID: %v", err)}
+	}
+	if !ok {
+		return nil, warnings, &appError{http.StatusNotFound, fmt.Sprintf("Invalid tour ID %d", order.TourID), nil}
+	}
+
+	data := &WaiverData{
+		TourDetail:   tourDetail,
+		OrderID:      order.ID,
+		Rider:        vars.Rider,
+		RiderDisplay: vars.Rider + 1,
+		Token:        vars.Token,
+		Version:      waiverVersion,
+		Text:         waiverTexts[waiverVersion],
+		Page:         s.page(r),
+	}
+	if vars.Rider < len(order.Riders) {
+		data.RiderName = order.Riders[vars.Rider].Name
+	}
+
+	if r.Method == "POST" {
+		name := strings.TrimSpace(vars.SignedName)
+		switch {
+		case vars.Version != waiverVersion:
+			data.Problem = "The waiver has been updated since this page was loaded. Please read it again before signing."
+		case !vars.Agree:
+			data.Problem = "Please tick the box to confirm that you agree."
+		case name == "":
+			data.Problem = "Please type your full name to sign."
+		default:
+			sig := &WaiverSignature{
+				OrderID:    order.ID,
+				RiderIndex: vars.Rider,
+				SignedName: name,
+				SignedAt:   time.Now(),
+				IP:         s.clientIP(r),
+				Version:    waiverVersion,
+			}
+			if _, err := s.store.CreateWaiverSignature(r.Context(), sig); err != nil {
+				return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("CreateWaiverSignature: %v", err)}
+			}
+		}
+		data.RiderName = name
+	}
+
+	sigs, err := s.store.GetOrderWaivers(r.Context(), order.ID)
+	if err != nil {
+		return nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetOrderWaivers: %v", err)}
+	}
+	for _, sig := range sigs {
+		if sig.RiderIndex == vars.Rider && sig.Version == waiverVersion {
+			sig.SignedAt = sig.SignedAt.In(data.TourDetail.Time.Location()) // in the tour's zone, like the tour time
+			data.Signed = sig
+		}
+	}
+	return data, warnings, nil
+}
+
+func (s *Server) HandleWaiver(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	data, warnings, e := s.waiver(r)
+	if e != nil {
+		if e.Error != nil {
+			s.log.Printf("%s: %v", e.Message, e.Error)
+		}
+		tmpl, err := s.templates.Get("checkout_error.html")
+		if err != nil {
+			s.log.Printf("%v", err)
+			http.Error(w, e.Message, e.Code)
+			return e.Code, warnings, e.Message
+		}
+		w.WriteHeader(e.Code)
+		if err := tmpl.Execute(w, &CheckoutErrorData{Page: s.page(r), Error: e.Message}); err != nil {
+			s.log.Printf("%v", err)
+			http.Error(w, e.Message, e.Code)
+			return e.Code, warnings, e.Message
+		}
+		return e.Code, warnings, e.Message
+	}
+	summary = fmt.Sprintf("order:%d rider:%d signed:%t", data.OrderID, data.Rider, data.Signed != nil)
+	tmpl, err := s.templates.Get("waiver.html")
+	if err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error parsing waiver template"
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		s.log.Printf("%v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, warnings, "Error executing waiver template"
+	}
+	return http.StatusOK, warnings, summary
+}
+
+// AdminWaiversVars represents the form inputs.
+type AdminWaiversVars struct {
+	TourID int32 `schema:"TourId"`
+}
+
+func (s *Server) adminWaivers(r *http.Request) (*TourDetail, []*WaiverSignature, map[warning]bool, *appError) {
+	warnings := make(map[warning]bool)
+	if !s.isAdmin(r) {
+		return nil, nil, warnings, &appError{http.StatusUnauthorized, "Unauthorized", nil}
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, warnings, &appError{http.StatusBadRequest, "Error parsing form", err}
+	}
+	var vars AdminWaiversVars
+	if err := s.decoder.Decode(&vars, r.Form); err != nil {
+		return nil, nil, warnings, &appError{http.StatusBadRequest, "Error decoding form values", err}
+	}
+	tourDetail, ok, err := s.store.GetTourDetailByID(r.Context(), vars.TourID, maxRiders)
+	if err != nil {
+		return nil, nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourDetailByID: %v", err)}
+	}
+	if !ok {
+		return nil, nil, warnings, &appError{http.StatusBadRequest, fmt.Sprintf("Invalid tour ID %d", vars.TourID), nil}
+	}
+	sigs, err := s.store.GetTourWaivers(r.Context(), vars.TourID)
+	if err != nil {
+		return nil, nil, warnings, &appError{http.StatusInternalServerError, "Server error", fmt.Errorf("GetTourWaivers: %v", err)}
+	}
+	return tourDetail, sigs, warnings, nil
+}
+
+// HandleAdminWaivers exports a tour's signed waivers as a PDF, one
+// signature per page.
+func (s *Server) HandleAdminWaivers(w http.ResponseWriter, r *http.Request) (code int, warnings map[warning]bool, summary string) {
+	tourDetail, sigs, warnings, e := s.adminWaivers(r)
+	if e != nil {
+		s.handleAdminError(w, e)
+		return e.Code, warnings, e.Message
+	}
+	pdf := waiversPDF(tourDetail, sigs)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"waivers-%s-%s.pdf\"", tourDetail.Time.Format("2006-01-02"), tourDetail.Code))
+	if err := pdf.Output(w); err != nil {
+		s.log.Printf("Error writing waivers PDF: %v", err)
+	}
+	return http.StatusOK, warnings, fmt.Sprintf("tour:%d waivers:%d", tourDetail.ID, len(sigs))
+}
+
+func waiversPDF(tourDetail *TourDetail, sigs []*WaiverSignature) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("") // UTF-8 to the core fonts' cp1252
+	tour := fmt.Sprintf("%s - %s, %s", tourDetail.Code, tourDetail.LongName, tourDetail.Time.Format("Monday, 2 January 2006 at 3:04 pm"))
+	if len(sigs) == 0 {
+		pdf.AddPage()
+		pdf.SetFont("Helvetica", "", 12)
+		pdf.MultiCell(0, 6, tr(tour+"\n\nNo waivers have been signed for this tour."), "", "L", false)
+	}
+	for _, sig := range sigs {
+		pdf.AddPage()
+		pdf.SetFont("Helvetica", "B", 16)
+		pdf.Cell(0, 10, "Bike the Big Apple - Liability Waiver")
+		pdf.Ln(12)
+		pdf.SetFont("Helvetica", "", 11)
+		pdf.MultiCell(0, 6, tr(tour), "", "L", false)
+		pdf.Ln(4)
+		for _, p := range waiverTexts[sig.Version] {
+			pdf.MultiCell(0, 5, tr(p), "", "L", false)
+			pdf.Ln(2)
+		}
+		pdf.Ln(6)
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.MultiCell(0, 6, tr(fmt.Sprintf("Signed: %s", sig.SignedName)), "", "L", false)
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(0, 5, tr(fmt.Sprintf(
+			"Order %d, rider #%d\nSigned at %s from %s\nWaiver version %s",
+			sig.OrderID, sig.RiderIndex+1, sig.SignedAt.In(tourDetail.Time.Location()).Format("2006-01-02 15:04:05 MST"), sig.IP, sig.Version)), "", "L", false)
+	}
+	return pdf
+}